@@ -1,6 +1,27 @@
 package hyperloglog
 
-import "math"
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrPrecisionMismatch is returned when combining sketches of different
+	// precisions.
+	ErrPrecisionMismatch = errors.New("precisions must be equal")
+
+	// ErrSeedMismatch is returned when merging sketches built with different
+	// hash seeds, whose registers do not describe the same hash space.
+	ErrSeedMismatch = errors.New("hash seeds must be equal")
+
+	// ErrInvalidPrecision is returned for a precision outside of the range
+	// supported by a sketch.
+	ErrInvalidPrecision = errors.New("invalid precision")
+
+	// ErrInvalidEncoding is returned when decoding malformed serialized data.
+	ErrInvalidEncoding = errors.New("invalid encoding")
+)
 
 type Hash32 interface {
 	Sum32() uint32
@@ -20,6 +41,9 @@ type set map[uint32]bool
 
 func (s set) Add(i uint32) { s[i] = true }
 
+// Clear removes every element of s, keeping the memory of the map.
+func (s set) Clear() { clear(s) }
+
 func alpha(m uint32) float64 {
 	if m == 16 {
 		return 0.673
@@ -93,7 +117,26 @@ func eb64(bits uint64, hi uint8, lo uint8) uint64 {
 	return (bits & m) >> lo
 }
 
-func linearCounting(m uint32, v uint32) float64 {
+// maxRank64 returns the largest rank of a 64-bit hash at precision p, 65-p,
+// reached when the 64-p bits below the register index are all zero.
+func maxRank64(p uint8) uint8 {
+	return 65 - p
+}
+
+// indexRank64 returns the register index of 64-bit hash x at precision p, taken
+// from its top p bits, and its rank, the position of the first set bit of the
+// remaining bits, capped at maxRank for registers of limited width.
+func indexRank64(x uint64, p, maxRank uint8) (uint64, uint8) {
+	i := eb64(x, 64, 64-p) // {x63,...,x64-p}
+	w := x<<p | 1<<(p-1)   // {x63-p,...,x0}
+	return i, min(clz64(w)+1, maxRank)
+}
+
+// Computes the linear counting estimate for m registers of which v are empty.
+// The counts are taken as uint64 so that sparse registers, of which there are
+// up to 2^25, never overflow in the callers. v must not be zero, for which the
+// estimate is infinite.
+func linearCounting(m uint64, v uint64) float64 {
 	fm := float64(m)
 	return fm * math.Log(fm/float64(v))
 }
@@ -109,12 +152,129 @@ func countZeros(s []uint8) uint32 {
 }
 
 func calculateEstimate(s []uint8) float64 {
+	return estimateFromSum(uint32(len(s)), registerSum(s))
+}
+
+// Computes the raw HyperLogLog estimate for m registers whose sum of 2^-r is
+// sum.
+func estimateFromSum(m uint32, sum float64) float64 {
+	fm := float64(m)
+	return alpha(m) * fm * fm / sum
+}
+
+// Returns the sum of 2^-r over all registers r, the denominator of the raw
+// HyperLogLog estimate.
+func registerSum(s []uint8) float64 {
 	sum := 0.0
 	for _, val := range s {
 		sum += 1.0 / float64(uint64(1)<<val)
 	}
+	return sum
+}
 
-	m := uint32(len(s))
+// compensatedRegisterSum is registerSum using Neumaier's compensated
+// summation, which keeps the low-order bits of small terms that a plain sum
+// drops once it has grown large.
+func compensatedRegisterSum(s []uint8) float64 {
+	var sum, c float64
+	for _, val := range s {
+		x := 1.0 / float64(uint64(1)<<val)
+		t := sum + x
+		if math.Abs(sum) >= math.Abs(x) {
+			c += (sum - t) + x
+		} else {
+			c += (x - t) + sum
+		}
+		sum = t
+	}
+	return sum + c
+}
+
+// RecommendPrecision returns the smallest precision at which the expected
+// relative standard error of a HyperLogLog64 or HyperLogLogPlus holding about
+// approxCardinality distinct items is at most targetError. If no supported
+// precision meets the target, the largest one is returned.
+func RecommendPrecision(approxCardinality uint64, targetError float64) uint8 {
+	maxPrecision := uint8(len(rawEstimateData) + minPrecision - 1)
+	for p := uint8(minPrecision); p < maxPrecision; p++ {
+		if expectedError(p, approxCardinality) <= targetError {
+			return p
+		}
+	}
+	return maxPrecision
+}
+
+// Returns the relative standard error of the estimate at precision p for n
+// distinct items. Below the threshold linear counting is used, whose error is
+// derived in Whang et al., "A Linear-Time Probabilistic Counting Algorithm for
+// Database Applications".
+func expectedError(p uint8, n uint64) float64 {
+	if n == 0 {
+		return 0
+	}
+
+	m := float64(uint64(1) << p)
+	if n <= uint64(threshold[p-minPrecision]) {
+		t := float64(n) / m
+		return math.Sqrt(m*(math.Exp(t)-t-1)) / float64(n)
+	}
+	return 1.04 / math.Sqrt(m)
+}
+
+// ExpectedNonZeroRegisters returns the expected number of nonzero registers of
+// a sketch with m registers holding the given number of distinct items,
+// m*(1-(1-1/m)^n), as each item lands in a uniformly random register. It is
+// the model behind linear counting, which inverts it to estimate n from the
+// number of zero registers, and can be compared with the NonZeroRegisters of
+// a Summary to check the hash.
+func ExpectedNonZeroRegisters(m uint32, cardinality uint64) float64 {
+	if m == 0 {
+		return 0
+	}
 	fm := float64(m)
-	return alpha(m) * fm * fm / sum
+	// (1-1/m)^n computed as exp(n*log(1-1/m)), keeping precision for large m.
+	return -fm * math.Expm1(float64(cardinality)*math.Log1p(-1/fm))
+}
+
+// Checks that a decoded precision p lies within [minPrecision, maxPrecision],
+// that m matches it and, for dense sketches, that there are m registers.
+func checkDecoded(p, maxPrecision uint8, m uint32, reg []uint8, dense bool) error {
+	if p < minPrecision || p > maxPrecision {
+		return fmt.Errorf("%w: precision %d out of range", ErrInvalidEncoding, p)
+	}
+	if m != 1<<p {
+		return fmt.Errorf("%w: m=%d does not match precision %d", ErrInvalidEncoding, m, p)
+	}
+	if dense && uint32(len(reg)) != m {
+		return fmt.Errorf("%w: %d registers for precision %d", ErrInvalidEncoding, len(reg), p)
+	}
+	return nil
+}
+
+// hashBytes is the hash used by AddBytes and AddString: 64-bit FNV-1a followed
+// by the MurmurHash3 finalizer, as FNV-1a alone mixes short inputs poorly into
+// the high bits that select the register.
+func hashBytes(b []byte) uint64 {
+	return hashBytesSeed(b, 0)
+}
+
+// hashBytesSeed is hashBytes with the FNV-1a offset basis perturbed by seed.
+// A zero seed gives the same hash as hashBytes.
+func hashBytesSeed(b []byte, seed uint64) uint64 {
+	x := uint64(14695981039346656037) ^ fmix64(seed)
+	for _, c := range b {
+		x ^= uint64(c)
+		x *= 1099511628211
+	}
+	return fmix64(x)
+}
+
+// The 64-bit finalizer of MurmurHash3.
+func fmix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
 }
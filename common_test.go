@@ -1,7 +1,10 @@
 package hyperloglog
 
 import (
+	"errors"
 	"math"
+	"math/big"
+	"math/rand"
 	"testing"
 )
 
@@ -259,3 +262,147 @@ func TestCalculateEstimate(t *testing.T) {
 		t.Error(v)
 	}
 }
+
+// Returns the registers of a precision 18 sketch whose first half has rank 1
+// and second half rank 47, the largest possible. The plain sum reaches 65536
+// after the first half, so the 2^-47 terms of the second half are below half
+// an ulp and are all dropped.
+func driftingRegisters() []uint8 {
+	reg := make([]uint8, 1<<18)
+	for i := range reg {
+		reg[i] = 1
+		if i >= len(reg)/2 {
+			reg[i] = 47
+		}
+	}
+	return reg
+}
+
+// Returns the sum of 2^-r over registers s, computed exactly and rounded once.
+func exactRegisterSum(s []uint8) float64 {
+	sum := new(big.Float).SetPrec(1024)
+	for _, r := range s {
+		sum.Add(sum, new(big.Float).SetMantExp(big.NewFloat(1), -int(r)))
+	}
+	f, _ := sum.Float64()
+	return f
+}
+
+func TestCompensatedRegisterSum(t *testing.T) {
+	reg := driftingRegisters()
+	exact := exactRegisterSum(reg)
+	naive, compensated := registerSum(reg), compensatedRegisterSum(reg)
+	if compensated != exact {
+		t.Error(compensated, exact)
+	}
+	if naive == exact || math.Abs(compensated-exact) >= math.Abs(naive-exact) {
+		t.Error(naive, compensated, exact)
+	}
+
+	for _, reg := range [][]uint8{{}, {0}, {0, 3, 63, 12}} {
+		if a, b := registerSum(reg), compensatedRegisterSum(reg); a != b {
+			t.Error(reg, a, b)
+		}
+	}
+}
+
+func TestRecommendPrecision(t *testing.T) {
+	for _, tc := range []struct {
+		n      uint64
+		target float64
+		want   uint8
+	}{
+		{1e6, 0.01, 14},
+		{1e6, 0.02, 12},
+		{1e6, 0.5, 4},
+		{1e9, 0.001, 18},
+		{100, 0.01, 13},
+		{0, 0.01, 4},
+	} {
+		if p := RecommendPrecision(tc.n, tc.target); p != tc.want {
+			t.Error(tc.n, tc.target, p)
+		}
+	}
+}
+
+func TestExpectedNonZeroRegisters(t *testing.T) {
+	if n := ExpectedNonZeroRegisters(1024, 0); n != 0 {
+		t.Error(n)
+	}
+	if n := ExpectedNonZeroRegisters(1024, 1); math.Abs(n-1) > 1e-9 {
+		t.Error(n)
+	}
+	if n := ExpectedNonZeroRegisters(1<<16, 1e9); n != 1<<16 {
+		t.Error(n)
+	}
+
+	h, _ := New64(12)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 4096; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	// About 63% of the registers are set, with a standard deviation of
+	// about 15 registers.
+	want := ExpectedNonZeroRegisters(4096, 4096)
+	if got := float64(h.Summary().NonZeroRegisters); math.Abs(got-want) > 60 {
+		t.Error(got, want)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	if _, err := New(3); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+	if _, err := New64(19); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+	if _, err := NewPlus(3); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+
+	h1, _ := New(4)
+	h2, _ := New(5)
+	if err := h1.Merge(h2); !errors.Is(err, ErrPrecisionMismatch) {
+		t.Error(err)
+	}
+
+	h641, _ := New64(4)
+	h642, _ := New64(5)
+	if err := h641.Merge(h642); !errors.Is(err, ErrPrecisionMismatch) {
+		t.Error(err)
+	}
+
+	hp1, _ := NewPlus(4)
+	hp2, _ := NewPlus(5)
+	if err := hp1.Merge(hp2); !errors.Is(err, ErrPrecisionMismatch) {
+		t.Error(err)
+	}
+
+	if _, err := FromPostgresHLL([]byte{0x11}); !errors.Is(err, ErrInvalidEncoding) {
+		t.Error(err)
+	}
+	var s SparseEncoding
+	if err := s.UnmarshalBinary([]byte{0x80}); !errors.Is(err, ErrInvalidEncoding) {
+		t.Error(err)
+	}
+}
+
+func TestIndexRank64(t *testing.T) {
+	for _, p := range []uint8{4, 14, 18} {
+		// x = 0 has all zero bits below the index, the highest possible rank.
+		i, r := indexRank64(0, p, maxRank64(p))
+		if i != 0 || r != 65-p {
+			t.Error(p, i, r)
+		}
+
+		// A narrower register clamps rather than wraps.
+		if _, r := indexRank64(0, p, 31); r != 31 {
+			t.Error(p, r)
+		}
+
+		i, r = indexRank64(1<<63|1<<(63-p), p, maxRank64(p))
+		if i != 1<<(p-1) || r != 1 {
+			t.Error(p, i, r)
+		}
+	}
+}
@@ -1,5 +1,14 @@
 package hyperloglog
 
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
 type iterable interface {
 	decode(i int, last uint32) (uint32, int)
 	Len() int
@@ -40,6 +49,13 @@ func newCompressedList(size int) *compressedList {
 	return v
 }
 
+// Reset empties compressedList v, keeping the capacity of its buffer.
+func (v *compressedList) Reset() {
+	v.Count = 0
+	v.b = v.b[:0]
+	v.last = 0
+}
+
 func (v *compressedList) Len() int {
 	return len(v.b)
 }
@@ -86,3 +102,195 @@ func (v variableLengthList) Append(x uint32) variableLengthList {
 	}
 	return append(v, uint8(x&0x7f))
 }
+
+// SparseEncoding is a list of uint32 values stored as variable length encoded
+// deltas, the encoding used by the sparse representation of HyperLogLogPlus.
+// Values should be appended in ascending order to keep the deltas small. The
+// zero value is an empty list.
+type SparseEncoding struct {
+	l compressedList
+}
+
+// Append adds x to the end of SparseEncoding e.
+func (e *SparseEncoding) Append(x uint32) {
+	e.l.Append(x)
+}
+
+// Count returns the number of values in SparseEncoding e.
+func (e *SparseEncoding) Count() uint32 {
+	return e.l.Count
+}
+
+// Len returns the number of bytes used to encode the values in
+// SparseEncoding e.
+func (e *SparseEncoding) Len() int {
+	return e.l.Len()
+}
+
+// Iter returns an iterator over the values in SparseEncoding e.
+func (e *SparseEncoding) Iter() *SparseIterator {
+	return &SparseIterator{e.l.Iter()}
+}
+
+// MarshalBinary encodes SparseEncoding e as the number of values and the last
+// value, both as uvarints, followed by the encoded deltas.
+func (e *SparseEncoding) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 2*binary.MaxVarintLen32+len(e.l.b))
+	b = binary.AppendUvarint(b, uint64(e.l.Count))
+	b = binary.AppendUvarint(b, uint64(e.l.last))
+	return append(b, e.l.b...), nil
+}
+
+// UnmarshalBinary decodes data produced by MarshalBinary into
+// SparseEncoding e.
+func (e *SparseEncoding) UnmarshalBinary(data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > math.MaxUint32 {
+		return fmt.Errorf("sparse encoding: %w: invalid count", ErrInvalidEncoding)
+	}
+	data = data[n:]
+	last, n := binary.Uvarint(data)
+	if n <= 0 || last > math.MaxUint32 {
+		return fmt.Errorf("sparse encoding: %w: invalid last value", ErrInvalidEncoding)
+	}
+	data = data[n:]
+	if len(data) > 0 && data[len(data)-1]&0x80 != 0 {
+		return fmt.Errorf("sparse encoding: %w: truncated value", ErrInvalidEncoding)
+	}
+
+	l := compressedList{b: append(variableLengthList(nil), data...)}
+	var c, x uint32
+	for iter := l.Iter(); iter.HasNext(); c++ {
+		x = iter.Next()
+	}
+	if c != uint32(count) || x != uint32(last) {
+		return fmt.Errorf("sparse encoding: %w: count or last value does not match values", ErrInvalidEncoding)
+	}
+
+	l.Count, l.last = c, x
+	e.l = l
+	return nil
+}
+
+// SparseIterator iterates over the values in a SparseEncoding.
+type SparseIterator struct {
+	iter *iterator
+}
+
+// HasNext reports whether there are more values.
+func (i *SparseIterator) HasNext() bool {
+	return i.iter.HasNext()
+}
+
+// Next returns the next value and advances the iterator.
+func (i *SparseIterator) Next() uint32 {
+	return i.iter.Next()
+}
+
+// Peek returns the next value without advancing the iterator.
+func (i *SparseIterator) Peek() uint32 {
+	return i.iter.Peek()
+}
+
+// SparseReader decodes the values of a SparseEncoding encoded by MarshalBinary
+// as they are read, so that lists too large to hold in memory can be
+// processed. It is returned by DecodeSparse.
+type SparseReader struct {
+	r           io.ByteReader
+	count, read uint32
+	last, x     uint32
+}
+
+// DecodeSparse reads the number of values and the last value of a
+// SparseEncoding encoded by MarshalBinary from r and returns a SparseReader
+// for the values that follow. r is wrapped in a bufio.Reader unless it is an
+// io.ByteReader, in which case nothing is read past the encoding.
+func DecodeSparse(r io.Reader) (*SparseReader, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil || count > math.MaxUint32 {
+		return nil, fmt.Errorf("sparse encoding: %w: invalid count", ErrInvalidEncoding)
+	}
+	last, err := binary.ReadUvarint(br)
+	if err != nil || last > math.MaxUint32 {
+		return nil, fmt.Errorf("sparse encoding: %w: invalid last value", ErrInvalidEncoding)
+	}
+	return &SparseReader{r: br, count: uint32(count), last: uint32(last)}, nil
+}
+
+// Count returns the number of values in the encoding read by SparseReader s.
+func (s *SparseReader) Count() uint32 {
+	return s.count
+}
+
+// Next returns the next value, or io.EOF once all values have been read. An
+// encoding that ends early or whose last value does not match its header
+// gives an error wrapping ErrInvalidEncoding, and other read errors are
+// returned as is.
+func (s *SparseReader) Next() (uint32, error) {
+	if s.read == s.count {
+		return 0, io.EOF
+	}
+
+	delta, err := binary.ReadUvarint(s.r)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("sparse encoding: %w: truncated value", ErrInvalidEncoding)
+	} else if err != nil {
+		return 0, err
+	}
+	if delta > math.MaxUint32 {
+		return 0, fmt.Errorf("sparse encoding: %w: value out of range", ErrInvalidEncoding)
+	}
+
+	s.x += uint32(delta)
+	s.read++
+	if s.read == s.count && s.x != s.last {
+		return 0, fmt.Errorf("sparse encoding: %w: count or last value does not match values", ErrInvalidEncoding)
+	}
+	return s.x, nil
+}
+
+// SparseRegisterReader decodes the values of the sparse list of a
+// HyperLogLogPlus into register indexes and ranks as they are read. It is
+// returned by DecodeSparseRegisters.
+type SparseRegisterReader struct {
+	s *SparseReader
+	h HyperLogLogPlus
+}
+
+// DecodeSparseRegisters is like DecodeSparse, but for the sparse list of a
+// HyperLogLogPlus of precision p and sparse precision sp, as held by a
+// SparseEncoding, whose values it decodes into the registers of a sketch of
+// precision p.
+func DecodeSparseRegisters(r io.Reader, p, sp uint8) (*SparseRegisterReader, error) {
+	if p > 18 || p < 4 {
+		return nil, fmt.Errorf("%w: must be between 4 and 18", ErrInvalidPrecision)
+	}
+	if sp <= p || sp > pPrime {
+		return nil, fmt.Errorf("%w: sparse precision must be between %d and %d", ErrInvalidPrecision, p+1, pPrime)
+	}
+
+	s, err := DecodeSparse(r)
+	if err != nil {
+		return nil, err
+	}
+	return &SparseRegisterReader{s: s, h: HyperLogLogPlus{p: p, sparseP: sp}}, nil
+}
+
+// Next returns the index and rank of the register of the next value, or
+// io.EOF once all values have been read, with the errors of
+// SparseReader.Next. An index is returned more than once if the list kept
+// several hashes of its register, in which case the register holds the
+// largest of their ranks.
+func (s *SparseRegisterReader) Next() (uint32, uint8, error) {
+	k, err := s.s.Next()
+	if err != nil {
+		return 0, 0, err
+	}
+	i, r := s.h.decodeHash(k)
+	return i, r, nil
+}
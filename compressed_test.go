@@ -2,6 +2,10 @@ package hyperloglog
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -127,3 +131,220 @@ func TestCompressedList(t *testing.T) {
 		t.Error(l)
 	}
 }
+
+func TestSparseEncodingBytes(t *testing.T) {
+	var e SparseEncoding
+	e.Append(106903)
+	e.Append(106903 + 0x7f)
+	e.Append(106903 + 0x7f + 0xff)
+
+	b, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Count 3, last 107285 and the three deltas.
+	b2 := []uint8{3, 149, 198, 6, 151, 195, 6, 0x7f, 0xff, 0x01}
+	if bytes.Compare(b, b2) != 0 {
+		t.Error(b)
+	}
+	if e.Len() != 6 {
+		t.Error(e.Len())
+	}
+
+	var e2 SparseEncoding
+	if err := e2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	iter := e2.Iter()
+	for _, x := range []uint32{106903, 106903 + 0x7f, 106903 + 0x7f + 0xff} {
+		if !iter.HasNext() {
+			t.Fatal("iterator ended early")
+		}
+		if n := iter.Next(); n != x {
+			t.Error(n)
+		}
+	}
+	if iter.HasNext() {
+		t.Error(iter)
+	}
+
+	for _, bad := range [][]uint8{
+		{},
+		{3, 149, 198, 6, 151, 195, 6, 0x7f, 0xff},
+		{2, 149, 198, 6, 151, 195, 6, 0x7f, 0xff, 0x01},
+		{3, 148, 198, 6, 151, 195, 6, 0x7f, 0xff, 0x01},
+	} {
+		if err := e2.UnmarshalBinary(bad); err == nil {
+			t.Error("expected error for", bad)
+		}
+	}
+}
+
+func TestSparseEncoding(t *testing.T) {
+	var l SparseEncoding
+
+	l.Append(0xff)
+
+	iter := l.Iter()
+
+	n := iter.Peek()
+	if n != 0xff {
+		t.Error(n)
+	}
+
+	n = iter.Next()
+	if n != 0xff {
+		t.Error(n)
+	}
+
+	l.Append(0xffffffff)
+	n = iter.Peek()
+	if n != 0xffffffff {
+		t.Error(n)
+	}
+	n = iter.Next()
+	if n != 0xffffffff {
+		t.Error(n)
+	}
+
+	l.Append(0xffff)
+	n = iter.Next()
+	if n != 0xffff {
+		t.Error(n)
+	}
+
+	l.Append(0xb0af1000)
+	n = iter.Next()
+	if n != 0xb0af1000 {
+		t.Error(n)
+	}
+
+	b, err := l.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l2 SparseEncoding
+	if err := l2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	iter = l2.Iter()
+	n = iter.Next()
+	if n != 0xff {
+		t.Error(n)
+	}
+	n = iter.Next()
+	if n != 0xffffffff {
+		t.Error(n)
+	}
+	n = iter.Next()
+	if n != 0xffff {
+		t.Error(n)
+	}
+	n = iter.Next()
+	if n != 0xb0af1000 {
+		t.Error(n)
+	}
+
+	if l2.Count() != 4 {
+		t.Error(l2.Count())
+	}
+	if uint32(l2.Len()) >= l2.Count()*4 {
+		t.Error(l2)
+	}
+}
+
+func TestDecodeSparse(t *testing.T) {
+	var e SparseEncoding
+	x := uint32(0)
+	for i := 0; i < 1e4; i++ {
+		x += uint32(rand.Intn(1 << 20))
+		e.Append(x)
+	}
+	b, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrap the buffer so that DecodeSparse has to buffer it itself.
+	s, err := DecodeSparse(struct{ io.Reader }{bytes.NewReader(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Count() != e.Count() {
+		t.Error(s.Count())
+	}
+	for iter := e.Iter(); iter.HasNext(); {
+		want := iter.Next()
+		n, err := s.Next()
+		if err != nil || n != want {
+			t.Fatal(n, want, err)
+		}
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Error(err)
+	}
+
+	for _, bad := range [][]uint8{
+		b[:len(b)-1],
+		{3, 149, 198, 6, 151, 195, 6, 0x7f, 0xfe, 0x01},
+	} {
+		s, err := DecodeSparse(bytes.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, err = s.Next()
+		}
+		if !errors.Is(err, ErrInvalidEncoding) {
+			t.Error(err)
+		}
+	}
+	if _, err := DecodeSparse(bytes.NewReader(nil)); !errors.Is(err, ErrInvalidEncoding) {
+		t.Error(err)
+	}
+}
+
+func TestDecodeSparseRegisters(t *testing.T) {
+	for _, sp := range []uint8{25, 18} {
+		h, _ := NewPlus(12, WithExplicitThreshold(0), WithSparsePrecision(sp))
+		for i := 0; i < 500; i++ {
+			h.Add(hash64(randStr(i)))
+		}
+		want := map[uint32]uint8{}
+		h.ForEachSparse(func(i uint32, r uint8) {
+			want[i] = r
+		})
+		if !h.sparse {
+			t.Fatal("not sparse")
+		}
+
+		b, err := (&SparseEncoding{*h.sparseList}).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := DecodeSparseRegisters(bytes.NewReader(b), h.p, h.sparseP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[uint32]uint8{}
+		for {
+			i, r, err := s.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got[i] = max(got[i], r)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sp=%d: got %d registers, want %d", sp, len(got), len(want))
+		}
+	}
+
+	for _, ps := range [][2]uint8{{3, 25}, {19, 25}, {12, 12}, {12, 26}} {
+		if _, err := DecodeSparseRegisters(bytes.NewReader(nil), ps[0], ps[1]); !errors.Is(err, ErrInvalidPrecision) {
+			t.Error(ps, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// defaultCountCacheSize is the number of counts kept by CountCached until
+// SetCountCacheSize is called.
+const defaultCountCacheSize = 128
+
+// countCache is the least recently used cache of counts shared by every
+// HyperLogLog64 through CountCached.
+var countCache = newCountLRU(defaultCountCacheSize)
+
+// SetCountCacheSize sets the number of counts kept by CountCached and empties
+// the cache. Each entry holds a copy of the registers it was counted from, so
+// the cache takes up to size times the register size of the sketches counted.
+// A size of 0 disables the cache.
+func SetCountCacheSize(size int) {
+	countCache.reset(size)
+}
+
+// CountCached returns the cardinality estimate of HyperLogLog64 h like Count,
+// but looks it up first in a cache shared by all sketches, keyed by a checksum
+// of the registers. Sketches loaded repeatedly with the same content, e.g. in a
+// read-heavy service, are then counted only once, even as different
+// instances. The registers of a hit are compared with those of h, so a
+// checksum collision is never mistaken for a hit. Sketches created with
+// WithAlpha or WithBiasTables bypass the cache. It is safe to call from
+// several goroutines as long as none of them modifies h.
+func (h *HyperLogLog64) CountCached() uint64 {
+	if h.alpha != nil || h.estTables != nil {
+		return h.Count()
+	}
+
+	key := countCacheKey(h)
+	if n, ok := countCache.get(key, h); ok {
+		return n
+	}
+	n := h.Count()
+	countCache.put(key, h, n)
+	return n
+}
+
+// Returns the checksum under which the count of h is cached.
+func countCacheKey(h *HyperLogLog64) uint64 {
+	return hashBytes(h.reg) ^ uint64(h.p)<<56 ^ uint64(h.rounding)<<48
+}
+
+// A countLRU is a least recently used cache of the counts of sketches by
+// register checksum.
+type countLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *countEntry, most recently used first
+	entries map[uint64]*list.Element
+	hits    int
+}
+
+type countEntry struct {
+	key      uint64
+	p        uint8
+	rounding RoundMode
+	reg      []uint8
+	count    uint64
+}
+
+func newCountLRU(size int) *countLRU {
+	c := &countLRU{}
+	c.reset(size)
+	return c
+}
+
+func (c *countLRU) reset(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.order = list.New()
+	c.entries = map[uint64]*list.Element{}
+	c.hits = 0
+}
+
+// Returns the cached count for key if it was computed from the registers of
+// h.
+func (c *countLRU) get(key uint64, h *HyperLogLog64) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	e := el.Value.(*countEntry)
+	if e.p != h.p || e.rounding != h.rounding || !bytes.Equal(e.reg, h.reg) {
+		return 0, false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return e.count, true
+}
+
+// Caches count n of the registers of h under key, replacing any entry with
+// the same key and evicting the least recently used one if the cache is full.
+func (c *countLRU) put(key uint64, h *HyperLogLog64, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Remove(c.order.Back()).(*countEntry)
+		delete(c.entries, oldest.key)
+	}
+
+	e := &countEntry{key: key, p: h.p, rounding: h.rounding, reg: append([]uint8(nil), h.reg...), count: n}
+	c.entries[key] = c.order.PushFront(e)
+}
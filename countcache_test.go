@@ -0,0 +1,53 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountCached(t *testing.T) {
+	SetCountCacheSize(2)
+	defer SetCountCacheSize(defaultCountCacheSize)
+
+	a, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e4; i++ {
+		a.AddUint64(r.Uint64())
+	}
+	data, err := a.MarshalBinary()
+	require.NoError(t, err)
+	var b HyperLogLog64
+	require.NoError(t, b.UnmarshalBinary(data))
+
+	// A separate instance with the same registers hits the cache.
+	require.Equal(t, a.Count(), a.CountCached())
+	require.Zero(t, countCache.hits)
+	require.Equal(t, a.Count(), b.CountCached())
+	require.Equal(t, 1, countCache.hits)
+
+	// Once modified, b no longer matches the cached registers.
+	b.AddUint64(r.Uint64())
+	require.Equal(t, b.Count(), b.CountCached())
+	require.Equal(t, 1, countCache.hits)
+
+	// A checksum collision is not a hit.
+	key := countCacheKey(a)
+	countCache.put(key, &b, 1)
+	require.Equal(t, a.Count(), a.CountCached())
+	require.Equal(t, 1, countCache.hits)
+
+	// The least recently used entry, that of b, is evicted.
+	c, _ := New64(14)
+	require.Zero(t, c.CountCached())
+	require.Equal(t, 2, countCache.order.Len())
+	require.Equal(t, a.Count(), a.CountCached())
+	require.Equal(t, 2, countCache.hits)
+	_, ok := countCache.get(countCacheKey(&b), &b)
+	require.False(t, ok)
+
+	SetCountCacheSize(0)
+	require.Equal(t, a.Count(), a.CountCached())
+	require.Zero(t, countCache.order.Len())
+}
@@ -0,0 +1,242 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Layout of the preamble of an Apache DataSketches HLL sketch. All integers
+// are little endian.
+const (
+	dsPreIntsByte = 0
+	dsSerVerByte  = 1
+	dsFamilyByte  = 2
+	dsLgKByte     = 3
+	dsLgArrByte   = 4
+	dsFlagsByte   = 5
+	dsListCount   = 6 // list mode
+	dsCurMinByte  = 6 // HLL mode
+	dsModeByte    = 7
+	dsSetCount    = 8  // set mode
+	dsHIPAccum    = 8  // HLL mode
+	dsKxQ0        = 16 // HLL mode
+	dsKxQ1        = 24 // HLL mode
+	dsNumAtCurMin = 32 // HLL mode
+	dsAuxCount    = 36 // HLL mode
+	dsListStart   = 8
+	dsSetStart    = 12
+	dsHLLStart    = 40
+
+	dsSerVer = 1
+	dsFamily = 7
+
+	dsFlagEmpty      = 1 << 2
+	dsFlagCompact    = 1 << 3
+	dsFlagOutOfOrder = 1 << 4
+
+	// Sketch modes, in the low two bits of the mode byte.
+	dsModeList = 0
+	dsModeSet  = 1
+	dsModeHLL  = 2
+
+	// Register layouts, in bits 2-3 of the mode byte.
+	dsHLL4 = 0
+	dsHLL6 = 1
+	dsHLL8 = 2
+
+	// A coupon is a 6-bit value above a 26-bit slot number.
+	dsKeyBits = 26
+	dsKeyMask = 1<<dsKeyBits - 1
+
+	// Marks a 4-bit register whose value is stored in the aux hash map.
+	dsAuxToken = 15
+)
+
+// FromDataSketches decodes an HLL sketch serialized by Apache DataSketches
+// (https://datasketches.apache.org), in Java or C++, into a HyperLogLog64 with
+// precision lgK. Both compact and updatable images in the list, set and HLL
+// modes are supported, for all of the HLL_4, HLL_6 and HLL_8 register layouts.
+// Sketches with lgK above 18 are folded to precision 18 by taking the maximum
+// of the registers whose slot numbers agree in the low 18 bits, which is how
+// DataSketches itself would have filled the smaller sketch.
+//
+// DataSketches takes the register index from the low bits of one half of a
+// 128-bit MurmurHash3 and the rank from the leading zeros of the other, so the
+// decoded sketch estimates the same cardinality, but should only be merged
+// with other sketches decoded by FromDataSketches. Ranks above 65-p, which are
+// practically impossible, are capped to fit a HyperLogLog64.
+func FromDataSketches(b []byte) (*HyperLogLog64, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("datasketches hll: %w: preamble too short", ErrInvalidEncoding)
+	}
+	if b[dsSerVerByte] != dsSerVer {
+		return nil, fmt.Errorf("datasketches hll: %w: unsupported serialization version %d", ErrInvalidEncoding, b[dsSerVerByte])
+	}
+	if b[dsFamilyByte] != dsFamily {
+		return nil, fmt.Errorf("datasketches hll: %w: not an HLL sketch (family %d)", ErrInvalidEncoding, b[dsFamilyByte])
+	}
+
+	lgK := b[dsLgKByte]
+	if lgK < minPrecision || lgK > 21 {
+		return nil, fmt.Errorf("datasketches hll: %w: lgK %d out of range", ErrInvalidEncoding, lgK)
+	}
+	h, err := New64(min(lgK, 18))
+	if err != nil {
+		return nil, fmt.Errorf("datasketches hll: %w", err)
+	}
+
+	flags := b[dsFlagsByte]
+	mode, layout := b[dsModeByte]&3, b[dsModeByte]>>2&3
+	if flags&dsFlagEmpty != 0 {
+		return h, nil
+	}
+
+	compact := flags&dsFlagCompact != 0
+	switch mode {
+	case dsModeList:
+		if b[dsPreIntsByte] != 2 {
+			return nil, fmt.Errorf("datasketches hll: %w: %d preamble ints in list mode", ErrInvalidEncoding, b[dsPreIntsByte])
+		}
+		err = h.addCoupons(b[dsListStart:], int(b[dsListCount]), b[dsLgArrByte], compact)
+	case dsModeSet:
+		if b[dsPreIntsByte] != 3 || len(b) < dsSetStart {
+			return nil, fmt.Errorf("datasketches hll: %w: bad set mode preamble", ErrInvalidEncoding)
+		}
+		n := binary.LittleEndian.Uint32(b[dsSetCount:])
+		err = h.addCoupons(b[dsSetStart:], int(n), b[dsLgArrByte], compact)
+	case dsModeHLL:
+		if b[dsPreIntsByte] != 10 || len(b) < dsHLLStart {
+			return nil, fmt.Errorf("datasketches hll: %w: bad HLL mode preamble", ErrInvalidEncoding)
+		}
+		err = h.addDataSketchesRegisters(b, lgK, layout, compact)
+	default:
+		return nil, fmt.Errorf("datasketches hll: %w: unsupported mode %d", ErrInvalidEncoding, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.registersChanged()
+	return h, nil
+}
+
+// Adds the coupons of a DataSketches list or set to the registers of h. A
+// compact image holds n coupons; otherwise the whole hash table of 2^lgArr
+// entries is stored, with zero marking empty entries.
+func (h *HyperLogLog64) addCoupons(data []byte, n int, lgArr uint8, compact bool) error {
+	if !compact {
+		if lgArr > dsKeyBits {
+			return fmt.Errorf("datasketches hll: %w: lgArr %d out of range", ErrInvalidEncoding, lgArr)
+		}
+		n = 1 << lgArr
+	}
+	if len(data) < 4*n {
+		return fmt.Errorf("datasketches hll: %w: coupons too short", ErrInvalidEncoding)
+	}
+
+	for i := 0; i < n; i++ {
+		c := binary.LittleEndian.Uint32(data[4*i:])
+		if c != 0 {
+			h.setDataSketchesRegister(c&dsKeyMask, uint8(c>>dsKeyBits))
+		}
+	}
+	return nil
+}
+
+// Adds the registers of a DataSketches sketch of precision lgK in HLL mode,
+// stored in the given layout, to the registers of h.
+func (h *HyperLogLog64) addDataSketchesRegisters(b []byte, lgK, layout uint8, compact bool) error {
+	k := uint32(1) << lgK
+	data := b[dsHLLStart:]
+
+	switch layout {
+	case dsHLL8:
+		if uint32(len(data)) < k {
+			return fmt.Errorf("datasketches hll: %w: HLL_8 registers too short", ErrInvalidEncoding)
+		}
+		for i := uint32(0); i < k; i++ {
+			h.setDataSketchesRegister(i, data[i])
+		}
+
+	case dsHLL6:
+		if uint32(len(data)) < k*3/4+1 {
+			return fmt.Errorf("datasketches hll: %w: HLL_6 registers too short", ErrInvalidEncoding)
+		}
+		for i := uint32(0); i < k; i++ {
+			off := 6 * i
+			v := binary.LittleEndian.Uint16(data[off/8:]) >> (off % 8) & 0x3f
+			h.setDataSketchesRegister(i, uint8(v))
+		}
+
+	case dsHLL4:
+		// Registers are offsets from curMin, two per byte with the even
+		// slot in the low nibble. Offsets that do not fit are stored in an
+		// aux hash map of coupons after the registers.
+		if uint32(len(data)) < k/2 {
+			return fmt.Errorf("datasketches hll: %w: HLL_4 registers too short", ErrInvalidEncoding)
+		}
+		curMin := b[dsCurMinByte]
+		for i := uint32(0); i < k; i++ {
+			v := data[i/2] >> (4 * (i & 1)) & 0xf
+			if v != dsAuxToken {
+				h.setDataSketchesRegister(i, curMin+v)
+			}
+		}
+
+		aux := data[k/2:]
+		n := int(binary.LittleEndian.Uint32(b[dsAuxCount:]))
+		if n == 0 {
+			return nil
+		}
+		return h.addCoupons(aux, n, b[dsLgArrByte], compact)
+
+	default:
+		return fmt.Errorf("datasketches hll: %w: unsupported register layout %d", ErrInvalidEncoding, layout)
+	}
+	return nil
+}
+
+// Raises the register of h for DataSketches slot number slot to value,
+// folding slots beyond the registers of h and capping the rank.
+func (h *HyperLogLog64) setDataSketchesRegister(slot uint32, value uint8) {
+	i := slot & (h.m - 1)
+	r := min(value, maxRank64(h.p))
+	if r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+// ToDataSketches encodes HyperLogLog64 h as a compact Apache DataSketches HLL
+// sketch of precision lgK = p in HLL mode with the HLL_8 register layout, the
+// binary format ingested by the HLLSketch aggregator of Apache Druid and read
+// by FromDataSketches. Register i of h becomes slot i. An empty h is encoded
+// as an empty sketch.
+//
+// As with FromDataSketches, the hash functions differ: the result estimates
+// the cardinality of h, but merging it with sketches DataSketches or Druid
+// built from the same items counts them twice, unless h was itself decoded by
+// FromDataSketches. The sketch is marked out of order, so DataSketches
+// estimates it from the registers rather than from its HIP accumulator.
+func (h *HyperLogLog64) ToDataSketches() ([]byte, error) {
+	if h.nonZero == 0 {
+		return []byte{2, dsSerVer, dsFamily, h.p, 0, dsFlagEmpty | dsFlagCompact, 0, dsHLL8<<2 | dsModeList}, nil
+	}
+
+	b := make([]byte, dsHLLStart, dsHLLStart+len(h.reg))
+	copy(b, []byte{10, dsSerVer, dsFamily, h.p, 0, dsFlagCompact | dsFlagOutOfOrder, 0, dsHLL8<<2 | dsModeHLL})
+
+	// DataSketches keeps the sum of 2^-r split at r = 32 for precision.
+	var kxq0, kxq1 float64
+	for _, r := range h.reg {
+		if r < 32 {
+			kxq0 += math.Ldexp(1, -int(r))
+		} else {
+			kxq1 += math.Ldexp(1, -int(r))
+		}
+	}
+	binary.LittleEndian.PutUint64(b[dsHIPAccum:], math.Float64bits(float64(h.Count())))
+	binary.LittleEndian.PutUint64(b[dsKxQ0:], math.Float64bits(kxq0))
+	binary.LittleEndian.PutUint64(b[dsKxQ1:], math.Float64bits(kxq1))
+	binary.LittleEndian.PutUint32(b[dsNumAtCurMin:], h.m-h.nonZero)
+	return append(b, h.reg...), nil
+}
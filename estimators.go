@@ -0,0 +1,183 @@
+package hyperloglog
+
+import "math"
+
+// EstimatorMethod selects the cardinality estimator used by
+// HyperLogLog64.CountWith.
+type EstimatorMethod int
+
+const (
+	// EstimatorOriginal is the bias corrected HyperLogLog++ estimator used by
+	// Count.
+	EstimatorOriginal EstimatorMethod = iota
+
+	// EstimatorErtl is the improved raw estimator described in "New
+	// cardinality estimation algorithms for HyperLogLog sketches" by Otmar
+	// Ertl. It needs no empirical bias correction and is accurate over the
+	// whole range of cardinalities.
+	EstimatorErtl
+
+	// EstimatorBeta is the LogLog-Beta estimator described in "LogLog-Beta
+	// and More: A New Algorithm for Cardinality Estimation Based on LogLog
+	// Counting" by Jason Qin et al. It uses the coefficients fitted for
+	// precision 14, as Redis does, and is less accurate at other precisions.
+	EstimatorBeta
+)
+
+// CountWith returns the cardinality estimate of HyperLogLog64 h computed with
+// the given estimator, so that a sketch can be evaluated with several
+// estimators without rebuilding it. Every estimator rounds as set by
+// WithRounding.
+func (h *HyperLogLog64) CountWith(method EstimatorMethod) uint64 {
+	switch method {
+	case EstimatorErtl:
+		return h.CountErtl()
+	case EstimatorBeta:
+		return h.round(betaEstimate(registerSum(h.reg), h.m-h.nonZero, h.m))
+	default:
+		return h.Count()
+	}
+}
+
+// CountErtl returns the cardinality estimate of HyperLogLog64 h computed with
+// EstimatorErtl.
+func (h *HyperLogLog64) CountErtl() uint64 {
+	return h.round(ertlEstimate(h.RegisterHistogram(), h.p))
+}
+
+// RegisterHistogram returns the number of registers of HyperLogLog64 h with
+// each value.
+func (h *HyperLogLog64) RegisterHistogram() [64]uint32 {
+	return registerHistogram(h.reg)
+}
+
+// RegisterContribution returns the term register index of HyperLogLog64 h adds
+// to the sum of 2^-r over all registers r, the denominator of the harmonic
+// mean used by Count. An empty register contributes 1, and each rank halves
+// the contribution, so comparing it with the total shows how much a single
+// register pulls the estimate up. It panics if index is out of range.
+func (h *HyperLogLog64) RegisterContribution(index uint32) float64 {
+	return math.Ldexp(1, -int(h.reg[index]))
+}
+
+// PartialEstimate returns the sum of 2^-r over the registers r of HyperLogLog64
+// h with index in [from, to), the share of those registers in the denominator
+// of the harmonic mean used by Count. It lets nodes that each own a range of
+// the registers of a sharded sketch report a single number: summing the
+// partials of disjoint ranges covering all m registers gives the full sum S,
+// and alpha(m) * m^2 / S is the raw HyperLogLog estimate of the whole sketch.
+// Above about 5m items this is the same as Count, which otherwise also
+// applies bias correction and, while registers are empty, linear counting. It
+// panics if the range is out of bounds.
+func (h *HyperLogLog64) PartialEstimate(from, to uint32) float64 {
+	return registerSum(h.reg[from:to])
+}
+
+// RankQuantiles returns the median, 90th and 99th percentile of the register
+// values of HyperLogLog64 h, including zero registers. For a good hash the
+// registers of a sketch holding n items follow the distribution of the
+// maximum of about n/m geometric variables, so a distribution skewed towards
+// high ranks for the count hints at a poor hash.
+func (h *HyperLogLog64) RankQuantiles() (p50, p90, p99 uint8) {
+	hist := h.RegisterHistogram()
+	return histogramQuantile(hist, h.m, 0.5), histogramQuantile(hist, h.m, 0.9), histogramQuantile(hist, h.m, 0.99)
+}
+
+// Returns the smallest register value v such that at least a fraction q of
+// the m registers counted in hist are at most v.
+func histogramQuantile(hist [64]uint32, m uint32, q float64) uint8 {
+	target := uint32(math.Ceil(q * float64(m)))
+	var seen uint32
+	for v, c := range hist {
+		seen += c
+		if seen >= target {
+			return uint8(v)
+		}
+	}
+	return uint8(len(hist) - 1)
+}
+
+// CountFromHistogram returns the cardinality estimate computed with
+// EstimatorErtl from hist, the register histogram of a HyperLogLog64 of
+// precision p as returned by RegisterHistogram. Callers that already have the
+// histogram avoid scanning the registers again. The estimate is truncated, as
+// by a sketch created without WithRounding.
+func CountFromHistogram(hist [64]uint32, p uint8) uint64 {
+	return uint64(ertlEstimate(hist, p))
+}
+
+// Returns the number of registers with each value. Values above 63, which no
+// precision produces but a corrupted sketch may hold, are counted as 63.
+func registerHistogram(s []uint8) [64]uint32 {
+	var hist [64]uint32
+	for _, v := range s {
+		hist[min(v, 63)]++
+	}
+	return hist
+}
+
+// Computes Ertl's improved raw estimate from the histogram of the registers
+// of a sketch of precision p using 64-bit hashes, whose registers range from 0
+// to 65-p.
+func ertlEstimate(hist [64]uint32, p uint8) float64 {
+	m := float64(uint32(1) << p)
+	q := 64 - int(p)
+
+	z := m * ertlTau(1-float64(hist[q+1])/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + float64(hist[k]))
+	}
+	z += m * ertlSigma(float64(hist[0])/m)
+	return m * m / (2 * math.Ln2 * z)
+}
+
+func ertlSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		next := z + x*y
+		y *= 2
+		if next == z {
+			return z
+		}
+		z = next
+	}
+}
+
+func ertlTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// The LogLog-Beta bias correction coefficients for precision 14.
+var betaCoefficients = [...]float64{
+	-0.370393911, 0.070471823, 0.17393686, 0.16339839,
+	-0.09237745, 0.03738027, -0.005384159, 0.00042419,
+}
+
+// Computes the LogLog-Beta estimate from the sum of 2^-r over all registers r
+// and the number of zero registers.
+func betaEstimate(sum float64, zeros uint32, m uint32) float64 {
+	fm, fz := float64(m), float64(zeros)
+	zl := math.Log(fz + 1)
+
+	beta := betaCoefficients[0] * fz
+	for i, zi := 1, zl; i < len(betaCoefficients); i, zi = i+1, zi*zl {
+		beta += betaCoefficients[i] * zi
+	}
+	return alpha(m) * fm * (fm - fz) / (beta + sum)
+}
@@ -0,0 +1,142 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountWith(t *testing.T) {
+	const p = 14
+	tolerance := 3 * 1.04 / math.Sqrt(1<<p)
+
+	h, _ := New64(p)
+	r := rand.New(rand.NewSource(1))
+	added := 0
+	for _, n := range []int{0, 1e3, 1e5, 1e6} {
+		for ; added < n; added++ {
+			h.AddUint64(r.Uint64())
+		}
+		n := float64(n)
+
+		require.Equal(t, h.Count(), h.CountWith(EstimatorOriginal))
+		for _, method := range []EstimatorMethod{EstimatorErtl, EstimatorBeta} {
+			if n == 0 {
+				require.Zero(t, h.CountWith(method), "method=%d", method)
+				continue
+			}
+			require.InEpsilon(t, n, h.CountWith(method), tolerance, "n=%v method=%d", n, method)
+		}
+	}
+}
+
+func TestCountWithRounding(t *testing.T) {
+	h, _ := New64(14, WithRounding(RoundNearest))
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		h.AddUint64(r.Uint64())
+	}
+
+	ertl := ertlEstimate(h.RegisterHistogram(), h.p)
+	require.Equal(t, uint64(math.Round(ertl)), h.CountWith(EstimatorErtl))
+	require.Equal(t, uint64(math.Round(ertl)), h.CountErtl())
+	beta := betaEstimate(registerSum(h.reg), h.m-h.nonZero, h.m)
+	require.Equal(t, uint64(math.Round(beta)), h.CountWith(EstimatorBeta))
+}
+
+func TestRegisterHistogramCorrupt(t *testing.T) {
+	h, _ := FromRegisters(4, []uint8{0, 1, 64, 255, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	var hist [64]uint32
+	require.NotPanics(t, func() { hist = h.RegisterHistogram() })
+	require.Equal(t, uint32(2), hist[63])
+	require.NotPanics(t, func() { h.CountWith(EstimatorErtl) })
+}
+
+func TestCountFromHistogram(t *testing.T) {
+	h, _ := New64(12)
+	added := 0
+	for _, n := range []int{0, 100, 1e4, 1e6} {
+		for ; added < n; added++ {
+			h.AddUint64(rand.Uint64())
+		}
+
+		hist := h.RegisterHistogram()
+		var total uint32
+		for _, c := range hist {
+			total += c
+		}
+		require.Equal(t, uint32(1<<12), total)
+		require.Equal(t, countZeros(h.reg), hist[0])
+		require.Equal(t, h.CountErtl(), CountFromHistogram(hist, h.p))
+	}
+}
+
+func TestRankQuantiles(t *testing.T) {
+	h, _ := New64(14)
+	p50, p90, p99 := h.RankQuantiles()
+	require.Zero(t, p50)
+	require.Zero(t, p90)
+	require.Zero(t, p99)
+
+	const n = 1 << 20
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		h.AddUint64(r.Uint64())
+	}
+
+	// Each register is the maximum rank of about lambda = n/m hashes, so
+	// P(register <= k) = exp(-lambda * 2^-k).
+	lambda := float64(n) / float64(h.m)
+	expected := func(q float64) uint8 {
+		for k := 0; ; k++ {
+			if math.Exp(-lambda*math.Ldexp(1, -k)) >= q {
+				return uint8(k)
+			}
+		}
+	}
+
+	p50, p90, p99 = h.RankQuantiles()
+	require.Equal(t, expected(0.5), p50)
+	require.Equal(t, expected(0.9), p90)
+	require.Equal(t, expected(0.99), p99)
+}
+
+func TestRegisterContribution(t *testing.T) {
+	// The smallest precision has 16 registers; set two of them.
+	h, _ := New64(4)
+	h.SetRegister(3, 1)
+	h.SetRegister(7, 5)
+
+	require.Equal(t, 0.5, h.RegisterContribution(3))
+	require.Equal(t, 1.0/32, h.RegisterContribution(7))
+	require.Equal(t, 1.0, h.RegisterContribution(0))
+
+	var sum float64
+	for i := uint32(0); i < h.m; i++ {
+		sum += h.RegisterContribution(i)
+	}
+	require.Equal(t, 14+0.5+1.0/32, sum)
+	require.Equal(t, registerSum(h.reg), sum)
+}
+
+func TestPartialEstimate(t *testing.T) {
+	h, _ := New64(12)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e6; i++ {
+		h.AddUint64(r.Uint64())
+	}
+
+	// Partials over disjoint ranges add up to the full sum, which gives the
+	// same estimate as Count at this cardinality.
+	var sum float64
+	for _, bounds := range [][2]uint32{{0, 1000}, {1000, 1024}, {1024, 3000}, {3000, 4096}} {
+		sum += h.PartialEstimate(bounds[0], bounds[1])
+	}
+	require.InDelta(t, registerSum(h.reg), sum, 1e-9)
+	require.InDelta(t, float64(h.Count()), alpha(h.m)*float64(h.m)*float64(h.m)/sum, 1)
+
+	require.Zero(t, h.PartialEstimate(10, 10))
+	require.Panics(t, func() { h.PartialEstimate(0, 4097) })
+}
@@ -0,0 +1,185 @@
+package hyperloglog
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// maxExprSketches is the largest number of distinct sketches an Expr may
+// refer to. Evaluation may count the union of every non-empty subset of them.
+const maxExprSketches = 10
+
+// Expr is a set-algebra expression over HyperLogLog64 sketches, built with
+// Operand, Union and Intersect. The expression is only evaluated by Count, so
+// the sketches may keep changing while the expression is held, and the same
+// expression can be counted again later.
+type Expr struct {
+	h    *HyperLogLog64 // set for operands
+	op   exprOp
+	args []*Expr
+}
+
+type exprOp int
+
+const (
+	exprOperand exprOp = iota
+	exprUnion
+	exprIntersect
+)
+
+// Operand returns an expression for the set represented by HyperLogLog64 h.
+func Operand(h *HyperLogLog64) *Expr {
+	return &Expr{h: h, op: exprOperand}
+}
+
+// Union returns an expression for the union of the given expressions.
+func Union(es ...*Expr) *Expr {
+	return &Expr{op: exprUnion, args: es}
+}
+
+// Intersect returns an expression for the intersection of the given
+// expressions.
+func Intersect(es ...*Expr) *Expr {
+	return &Expr{op: exprIntersect, args: es}
+}
+
+// Count returns the cardinality estimate of expression e. None of the
+// sketches are modified.
+//
+// The expression is rewritten into a signed sum of union counts of its
+// sketches, each of which is computed by merging into a single scratch
+// sketch, so unions are as accurate as Count while intersections carry the
+// same error as IntersectMany. A sketch used more than once in e is counted
+// as the same set. At most 10 distinct sketches are accepted, and all of them
+// must have the same precision.
+func (e *Expr) Count() (uint64, error) {
+	var hs []*HyperLogLog64
+	poly, err := e.expand(&hs)
+	if err != nil {
+		return 0, err
+	}
+	for _, h := range hs[1:] {
+		if h.p != hs[0].p {
+			return 0, ErrPrecisionMismatch
+		}
+		if h.seed != hs[0].seed {
+			return 0, ErrSeedMismatch
+		}
+	}
+
+	// Each term of poly is the size of the intersection of the sketches in
+	// its mask, which inclusion-exclusion turns into union counts. Collect
+	// the coefficient of every union first so each is counted only once.
+	coef := make([]int, 1<<len(hs))
+	for mask, c := range poly {
+		for subset := mask; subset != 0; subset = (subset - 1) & mask {
+			if bits.OnesCount32(subset)%2 == 1 {
+				coef[subset] += c
+			} else {
+				coef[subset] -= c
+			}
+		}
+	}
+
+	u, err := New64WithSeed(hs[0].p, hs[0].seed, WithAlpha(hs[0].alpha), WithRounding(hs[0].rounding))
+	if err != nil {
+		return 0, err
+	}
+	u.estTables, u.biasTables = hs[0].estTables, hs[0].biasTables
+
+	var sum float64
+	for subset, c := range coef {
+		if c == 0 {
+			continue
+		}
+		u.Clear()
+		for i, h := range hs {
+			if subset&(1<<i) != 0 {
+				if err := u.Merge(h); err != nil {
+					return 0, err
+				}
+			}
+		}
+		sum += float64(c) * float64(u.Count())
+	}
+
+	if sum < 0 {
+		return 0, nil
+	}
+	return uint64(sum), nil
+}
+
+// Expands expression e into a polynomial over the indicator functions of its
+// sketches, appending newly seen sketches to hs. Each key is a mask of the
+// sketches in hs whose indicators are multiplied together, so the term stands
+// for the size of their intersection. Indicators are idempotent, so a product
+// never needs a sketch twice.
+func (e *Expr) expand(hs *[]*HyperLogLog64) (map[uint32]int, error) {
+	switch e.op {
+	case exprOperand:
+		if e.h == nil {
+			return nil, errors.New("nil operand")
+		}
+		for i, h := range *hs {
+			if h == e.h {
+				return map[uint32]int{1 << i: 1}, nil
+			}
+		}
+		if len(*hs) == maxExprSketches {
+			return nil, fmt.Errorf("expression must have at most %d distinct sketches", maxExprSketches)
+		}
+		*hs = append(*hs, e.h)
+		return map[uint32]int{1 << (len(*hs) - 1): 1}, nil
+
+	case exprUnion, exprIntersect:
+		if len(e.args) == 0 {
+			return nil, errors.New("expression has no operands")
+		}
+		acc, err := e.args[0].expand(hs)
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range e.args[1:] {
+			q, err := arg.expand(hs)
+			if err != nil {
+				return nil, err
+			}
+			pq := polyMul(acc, q)
+			if e.op == exprUnion {
+				// 1 - (1-a)(1-b) = a + b - ab
+				for mask, c := range q {
+					acc[mask] += c
+				}
+				for mask, c := range pq {
+					acc[mask] -= c
+				}
+				for mask, c := range acc {
+					if c == 0 {
+						delete(acc, mask)
+					}
+				}
+			} else {
+				acc = pq
+			}
+		}
+		return acc, nil
+	}
+	panic("unknown expression")
+}
+
+// Multiplies two polynomials over idempotent indicator functions.
+func polyMul(a, b map[uint32]int) map[uint32]int {
+	out := make(map[uint32]int, len(a)*len(b))
+	for ma, ca := range a {
+		for mb, cb := range b {
+			out[ma|mb] += ca * cb
+		}
+	}
+	for mask, c := range out {
+		if c == 0 {
+			delete(out, mask)
+		}
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package hyperloglog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExprCount(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(14)
+	c, _ := New64(14)
+
+	// A = [0, 20000), B = [10000, 30000), C = [15000, 40000), so
+	// (A ∪ B) ∩ C = [15000, 30000).
+	for i := uint64(0); i < 40000; i++ {
+		x := fmix64(i)
+		if i < 20000 {
+			a.AddUint64(x)
+		}
+		if i >= 10000 && i < 30000 {
+			b.AddUint64(x)
+		}
+		if i >= 15000 {
+			c.AddUint64(x)
+		}
+	}
+
+	n, err := Intersect(Union(Operand(a), Operand(b)), Operand(c)).Count()
+	require.NoError(t, err)
+	require.InEpsilon(t, 15000, n, 0.05)
+
+	// A ∪ (B ∩ C) = [0, 30000).
+	n, err = Union(Operand(a), Intersect(Operand(b), Operand(c))).Count()
+	require.NoError(t, err)
+	require.InEpsilon(t, 30000, n, 0.05)
+
+	n, err = Union(Operand(a), Operand(b), Operand(c)).Count()
+	require.NoError(t, err)
+	u, _ := New64(14)
+	u.MergeMany(a, b, c)
+	require.Equal(t, u.Count(), n)
+
+	// The same sketch twice is the same set.
+	n, err = Intersect(Operand(a), Operand(a)).Count()
+	require.NoError(t, err)
+	require.Equal(t, a.Count(), n)
+}
+
+func TestExprErrors(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(12)
+
+	_, err := Union(Operand(a), Operand(b)).Count()
+	require.ErrorIs(t, err, ErrPrecisionMismatch)
+
+	_, err = Intersect().Count()
+	require.Error(t, err)
+
+	s, _ := New64WithSeed(14, 7)
+	_, err = Union(Operand(a), Operand(s)).Count()
+	require.ErrorIs(t, err, ErrSeedMismatch)
+}
+
+func TestExprCountSeeded(t *testing.T) {
+	a, _ := New64WithSeed(14, 7)
+	b, _ := New64WithSeed(14, 7)
+	// A = [0, 10000) and B = [5000, 15000) share 5000 items.
+	for i := uint64(0); i < 15000; i++ {
+		if i < 10000 {
+			a.AddUint64(fmix64(i))
+		}
+		if i >= 5000 {
+			b.AddUint64(fmix64(i))
+		}
+	}
+
+	n, err := Intersect(Operand(a), Operand(b)).Count()
+	require.NoError(t, err)
+	require.InEpsilon(t, 5000, n, 0.1)
+}
@@ -0,0 +1,52 @@
+package hyperloglog
+
+// FrozenHLL is a read-only HyperLogLog64 returned by HyperLogLog64.Freeze. It
+// has no methods that modify it, so it can be shared between goroutines
+// without locking.
+type FrozenHLL struct {
+	h *HyperLogLog64
+}
+
+// Freeze returns a read-only copy of HyperLogLog64 h. The registers are
+// copied, so that later changes to h do not affect the FrozenHLL.
+func (h *HyperLogLog64) Freeze() *FrozenHLL {
+	return &FrozenHLL{h: h.Clone()}
+}
+
+// Clone returns a copy of HyperLogLog64 h that does not share its registers.
+func (h *HyperLogLog64) Clone() *HyperLogLog64 {
+	c := *h
+	c.reg = append([]uint8(nil), h.reg...)
+	return &c
+}
+
+// Count returns the cardinality estimate.
+func (f *FrozenHLL) Count() uint64 {
+	return f.h.Count()
+}
+
+// SeenUint64 checks whether an uint64 has been seen already (probabilistically).
+func (f *FrozenHLL) SeenUint64(x uint64) bool {
+	return f.h.SeenUint64(x)
+}
+
+// Clone returns a modifiable copy of FrozenHLL f.
+func (f *FrozenHLL) Clone() *HyperLogLog64 {
+	return f.h.Clone()
+}
+
+// MergeInto combines FrozenHLL f into dst.
+func (f *FrozenHLL) MergeInto(dst *HyperLogLog64) error {
+	return dst.Merge(f.h)
+}
+
+// MarshalBinary encodes FrozenHLL f like HyperLogLog64.MarshalBinary.
+func (f *FrozenHLL) MarshalBinary() ([]byte, error) {
+	return f.h.MarshalBinary()
+}
+
+// AppendTo appends the encoding of FrozenHLL f produced by MarshalBinary to
+// dst and returns the extended slice.
+func (f *FrozenHLL) AppendTo(dst []byte) []byte {
+	return f.h.AppendTo(dst)
+}
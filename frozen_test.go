@@ -0,0 +1,55 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrozenHLL(t *testing.T) {
+	h, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	f := h.Freeze()
+	n := h.Count()
+	require.Equal(t, n, f.Count())
+
+	// FrozenHLL must not have any method that modifies it.
+	typ := reflect.TypeOf(f)
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		if strings.HasPrefix(name, "Add") || strings.HasPrefix(name, "Merge") && name != "MergeInto" ||
+			name == "Clear" || name == "Restore" {
+			t.Error("FrozenHLL has method", name)
+		}
+	}
+
+	// Later changes to h must not affect f.
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	require.Equal(t, n, f.Count())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, n, f.Count())
+		}()
+	}
+	wg.Wait()
+
+	c := f.Clone()
+	c.AddUint64(rand.Uint64())
+	require.Equal(t, n, f.Count())
+
+	u, _ := New64(14)
+	require.NoError(t, f.MergeInto(u))
+	require.Equal(t, n, u.Count())
+}
@@ -0,0 +1,91 @@
+package hyperloglog
+
+import "math"
+
+// HyperLogLogGenerational is a HyperLogLog64 whose Clear takes constant time,
+// for sketches reused across many short-lived windows. Each register is
+// stored with the generation that last wrote it, and Clear starts a new
+// generation, so registers written by older generations read as zero. This
+// costs two bytes of memory per register on top of the rank.
+type HyperLogLogGenerational struct {
+	reg     []uint8
+	gen     []uint16 // generation of each register in reg
+	cur     uint16
+	m       uint32
+	p       uint8
+	nonZero uint32 // number of registers written in the current generation
+}
+
+// NewGenerational returns a new initialized HyperLogLogGenerational.
+func NewGenerational(precision uint8) (*HyperLogLogGenerational, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
+	}
+
+	h := &HyperLogLogGenerational{}
+	h.p = precision
+	h.m = 1 << precision
+	h.reg = make([]uint8, h.m)
+	h.gen = make([]uint16, h.m)
+	h.cur = 1
+	return h, nil
+}
+
+// Clear sets HyperLogLogGenerational h back to its initial state. Once every
+// 65535 calls the generations wrap around and all of them are reset.
+func (h *HyperLogLogGenerational) Clear() {
+	h.nonZero = 0
+	if h.cur < math.MaxUint16 {
+		h.cur++
+		return
+	}
+	clear(h.gen)
+	h.cur = 1
+}
+
+// Returns register i of HyperLogLogGenerational h in the current generation.
+func (h *HyperLogLogGenerational) get(i uint64) uint8 {
+	if h.gen[i] != h.cur {
+		return 0
+	}
+	return h.reg[i]
+}
+
+// Add adds a new item to HyperLogLogGenerational h.
+func (h *HyperLogLogGenerational) Add(item Hash64) {
+	h.AddUint64(item.Sum64())
+}
+
+// AddUint64 adds a new hash to HyperLogLogGenerational h.
+func (h *HyperLogLogGenerational) AddUint64(x uint64) {
+	i, r := indexRank64(x, h.p, maxRank64(h.p))
+	if h.gen[i] != h.cur {
+		h.gen[i] = h.cur
+		h.reg[i] = r
+		h.nonZero++
+	} else if r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+// Count returns the cardinality estimate.
+func (h *HyperLogLogGenerational) Count() uint64 {
+	var sum float64
+	for i := range h.reg {
+		sum += 1.0 / float64(uint64(1)<<h.get(uint64(i)))
+	}
+
+	n, _ := (&HyperLogLog64{m: h.m, p: h.p}).estimateFrom(sum, h.m-h.nonZero)
+	return n
+}
+
+// ToHLL64 returns a HyperLogLog64 holding a copy of the registers of
+// HyperLogLogGenerational h in the current generation.
+func (h *HyperLogLogGenerational) ToHLL64() *HyperLogLog64 {
+	h64, _ := New64(h.p)
+	for i := range h64.reg {
+		h64.reg[i] = h.get(uint64(i))
+	}
+	h64.registersChanged()
+	return h64
+}
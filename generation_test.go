@@ -0,0 +1,71 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerationalAcrossGenerations(t *testing.T) {
+	g, _ := NewGenerational(12)
+	require.Zero(t, g.Count())
+
+	r := rand.New(rand.NewSource(1))
+	for window, n := range []int{1e4, 10, 0, 1e3, 5e4} {
+		h, _ := New64(12)
+		for i := 0; i < n; i++ {
+			x := r.Uint64()
+			g.AddUint64(x)
+			h.AddUint64(x)
+		}
+
+		require.Equal(t, h.reg, g.ToHLL64().reg, "window=%d", window)
+		require.Equal(t, h.Count(), g.Count(), "window=%d", window)
+		g.Clear()
+		require.Zero(t, g.Count())
+	}
+}
+
+func TestGenerationalWrap(t *testing.T) {
+	g, _ := NewGenerational(10)
+	g.cur = math.MaxUint16 - 1
+	r := rand.New(rand.NewSource(1))
+	for gen := 0; gen < 3; gen++ {
+		for i := 0; i < 100; i++ {
+			g.AddUint64(r.Uint64())
+		}
+		require.InEpsilon(t, 100, g.Count(), 0.05)
+		g.Clear()
+		require.Zero(t, g.Count())
+		require.Zero(t, g.ToHLL64().nonZero)
+	}
+}
+
+func BenchmarkClearHeavy(b *testing.B) {
+	const p, perWindow = 16, 100
+	xs := make([]uint64, perWindow)
+	for i := range xs {
+		xs[i] = rand.Uint64()
+	}
+
+	b.Run("HyperLogLog64", func(b *testing.B) {
+		h, _ := New64(p)
+		for i := 0; i < b.N; i++ {
+			for _, x := range xs {
+				h.AddUint64(x)
+			}
+			h.Clear()
+		}
+	})
+	b.Run("HyperLogLogGenerational", func(b *testing.B) {
+		h, _ := NewGenerational(p)
+		for i := 0; i < b.N; i++ {
+			for _, x := range xs {
+				h.AddUint64(x)
+			}
+			h.Clear()
+		}
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !hllsafe
+
+package hyperloglog
+
+// Reports whether i indexes a register of HyperLogLog64 h. Default builds
+// trust the index derived from the hash; build with the hllsafe tag to check
+// it against the register slice.
+func (h *HyperLogLog64) validRegister(i uint64) bool {
+	return true
+}
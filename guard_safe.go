@@ -0,0 +1,15 @@
+//go:build hllsafe
+
+package hyperloglog
+
+import "log"
+
+// Reports whether i indexes a register of HyperLogLog64 h, logging the
+// corruption instead of panicking when the register slice is shorter than m.
+func (h *HyperLogLog64) validRegister(i uint64) bool {
+	if i < uint64(len(h.reg)) {
+		return true
+	}
+	log.Printf("hyperloglog: register %d out of range for %d registers of precision %d", i, len(h.reg), h.p)
+	return false
+}
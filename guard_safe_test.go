@@ -0,0 +1,56 @@
+//go:build hllsafe
+
+package hyperloglog
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL64UndersizedRegisters(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	h, _ := New64(8)
+	h.reg = h.reg[:16]
+	require.NotPanics(t, func() {
+		h.AddUint64(0xff00000000000000) // register 255
+		h.AddUint64(0x0140000000000000) // register 1, rank 2
+	})
+	require.Equal(t, uint8(2), h.reg[1])
+	require.Equal(t, uint32(1), h.nonZero)
+	require.True(t, strings.Contains(buf.String(), "register 255 out of range for 16 registers"), buf.String())
+}
+
+func TestHLL64UndersizedRegistersSeen(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	h, _ := New64(8)
+	h.reg = h.reg[:16]
+	const out, in = 0xff00000000000000, 0x0140000000000000 // registers 255 and 1
+
+	require.NotPanics(t, func() {
+		require.False(t, h.AddIfAbsent(out))
+		require.True(t, h.AddIfAbsent(in))
+		require.False(t, h.AddIfAbsent(in))
+	})
+	require.NotPanics(t, func() {
+		require.False(t, h.SeenUint64(out))
+		require.True(t, h.SeenUint64(in))
+	})
+	require.NotPanics(t, func() {
+		require.Equal(t, []bool{false, true}, h.SeenMany([]uint64{out, in}))
+	})
+	require.NotPanics(t, func() {
+		require.Zero(t, h.SeenConfidence(out))
+		require.NotZero(t, h.SeenConfidence(in))
+	})
+}
@@ -0,0 +1,21 @@
+// Package hlltest provides helpers for measuring the accuracy of
+// hyperloglog sketches in tests and benchmarks.
+package hlltest
+
+import "github.com/clarkduvall/hyperloglog"
+
+// AccuracyReport compares the estimate of HyperLogLog64 h against exact, the
+// set of hashes added to it. It returns the true count, the estimate, and the
+// signed relative error of the estimate, (est - trueCount) / trueCount, which
+// is 0 when exact is empty and h estimates 0.
+func AccuracyReport(exact map[uint64]struct{}, h *hyperloglog.HyperLogLog64) (trueCount uint64, est uint64, relErr float64) {
+	trueCount = uint64(len(exact))
+	est = h.Count()
+	if trueCount == 0 {
+		if est == 0 {
+			return trueCount, est, 0
+		}
+		return trueCount, est, 1
+	}
+	return trueCount, est, (float64(est) - float64(trueCount)) / float64(trueCount)
+}
@@ -0,0 +1,35 @@
+package hlltest
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/clarkduvall/hyperloglog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccuracyReport(t *testing.T) {
+	h, err := hyperloglog.New64(16)
+	require.NoError(t, err)
+
+	n, est, relErr := AccuracyReport(map[uint64]struct{}{}, h)
+	require.Zero(t, n)
+	require.Zero(t, est)
+	require.Zero(t, relErr)
+
+	const count = 1e5
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[uint64]struct{}, count)
+	for len(seen) < count {
+		x := r.Uint64()
+		h.AddUint64(x)
+		seen[x] = struct{}{}
+	}
+
+	n, est, relErr = AccuracyReport(seen, h)
+	require.Equal(t, uint64(count), n)
+	require.Equal(t, h.Count(), est)
+	// The same measurement done inline in TestHLL64CountMany.
+	require.Equal(t, (float64(est)-float64(count))/float64(count), relErr)
+	require.InDelta(t, 0, relErr, 0.02)
+}
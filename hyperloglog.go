@@ -14,22 +14,30 @@ package hyperloglog
 import (
 	"bytes"
 	"encoding/gob"
-	"errors"
+	"fmt"
 	"math"
 )
 
 const two32 = 1 << 32
 
+// HyperLogLog is the original HyperLogLog using 32-bit hashes, the
+// alpha-corrected raw estimator and the 2^32 large range correction. It uses
+// less memory than HyperLogLogPlus and matches the estimates of other classic
+// implementations, at the cost of a larger error for small cardinalities.
 type HyperLogLog struct {
 	reg []uint8
 	m   uint32
 	p   uint8
 }
 
+// HyperLogLog32 is an alias for HyperLogLog, naming its hash width explicitly
+// alongside HyperLogLog64.
+type HyperLogLog32 = HyperLogLog
+
 // New returns a new initialized HyperLogLog.
 func New(precision uint8) (*HyperLogLog, error) {
 	if precision > 16 || precision < 4 {
-		return nil, errors.New("precision must be between 4 and 16")
+		return nil, fmt.Errorf("%w: must be between 4 and 16", ErrInvalidPrecision)
 	}
 
 	h := &HyperLogLog{}
@@ -59,7 +67,7 @@ func (h *HyperLogLog) Add(item Hash32) {
 // Merge takes another HyperLogLog and combines it with HyperLogLog h.
 func (h *HyperLogLog) Merge(other *HyperLogLog) error {
 	if h.p != other.p {
-		return errors.New("precisions must be equal")
+		return ErrPrecisionMismatch
 	}
 
 	for i, v := range other.reg {
@@ -75,7 +83,7 @@ func (h *HyperLogLog) Count() uint64 {
 	est := calculateEstimate(h.reg)
 	if est <= float64(h.m)*2.5 {
 		if v := countZeros(h.reg); v != 0 {
-			return uint64(linearCounting(h.m, v))
+			return uint64(linearCounting(uint64(h.m), uint64(v)))
 		}
 		return uint64(est)
 	} else if est < two32/30 {
@@ -112,5 +120,5 @@ func (h *HyperLogLog) GobDecode(b []byte) error {
 	if err := dec.Decode(&h.p); err != nil {
 		return err
 	}
-	return nil
+	return checkDecoded(h.p, 16, h.m, h.reg, true)
 }
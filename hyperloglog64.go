@@ -13,89 +13,960 @@ package hyperloglog
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"unsafe"
 )
 
 type HyperLogLog64 struct {
 	reg []uint8
 	m   uint32
 	p   uint8
+
+	// alpha overrides the bias correction constant used by Count when set.
+	alpha func(m uint32) float64
+
+	rounding RoundMode
+
+	// estTables and biasTables replace rawEstimateData and biasData when
+	// set.
+	estTables, biasTables [][]float64
+
+	// seed perturbs the hash used by AddBytes and AddString. Zero is the
+	// default hash.
+	seed uint64
+
+	// nonZero is the number of nonzero registers, kept up to date by every
+	// method that modifies reg.
+	nonZero uint32
+
+	// While tracking, AddUint64 keeps runSum equal to the registerSum of reg,
+	// for AddAndEstimate. Other changes to reg stop tracking.
+	tracking bool
+	runSum   float64
+	runAdds  int
+
+	// merged is the number of sketches combined into h by merging, and
+	// degraded is set once MergeFold lowered the precision of either side.
+	merged   int
+	degraded bool
+}
+
+// An Option configures a HyperLogLog64 created by New64.
+type Option func(*HyperLogLog64)
+
+// WithAlpha makes Count use f(m) instead of the standard bias correction
+// constant for m registers, for experimenting with alternative constants. It
+// is not preserved by GobEncode.
+func WithAlpha(f func(m uint32) float64) Option {
+	return func(h *HyperLogLog64) {
+		h.alpha = f
+	}
+}
+
+// RoundMode selects how Count converts the estimate to an integer.
+type RoundMode int
+
+const (
+	// RoundTruncate rounds the estimate towards zero, which biases counts
+	// slightly low.
+	RoundTruncate RoundMode = iota
+
+	// RoundNearest rounds the estimate to the nearest integer.
+	RoundNearest
+)
+
+// WithRounding sets how Count rounds the estimate. The default is
+// RoundTruncate. It is not preserved by GobEncode.
+func WithRounding(mode RoundMode) Option {
+	return func(h *HyperLogLog64) {
+		h.rounding = mode
+	}
+}
+
+// WithBiasTables makes Count correct the bias of small estimates with the
+// given tables instead of the empirically determined ones built into the
+// package, e.g. to try regenerated tables. Both have one table per precision
+// from 4 to 18; the bias for raw estimate estimates[i][j] is biases[i][j],
+// with the raw estimates in ascending order. New64 returns an error if the
+// tables do not have this shape. The tables are not copied, and are not
+// preserved by GobEncode.
+func WithBiasTables(estimates, biases [][]float64) Option {
+	return func(h *HyperLogLog64) {
+		h.estTables, h.biasTables = estimates, biases
+	}
 }
 
 // New64 returns a new initialized HyperLogLog64.
-func New64(precision uint8) (*HyperLogLog64, error) {
-	maxPrecision := len(rawEstimateData) + minPrecision - 1
-	if precision > uint8(maxPrecision) || precision < 4 {
-		return nil, fmt.Errorf("precision must be between %d and %d", minPrecision, maxPrecision)
+func New64(precision uint8, opts ...Option) (*HyperLogLog64, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
 	}
 
 	h := &HyperLogLog64{}
 	h.p = precision
 	h.m = 1 << precision
 	h.reg = make([]uint8, h.m)
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.estTables != nil || h.biasTables != nil {
+		if err := checkBiasTables(h.estTables, h.biasTables); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Checks that estimates and biases have the shape of rawEstimateData and
+// biasData.
+func checkBiasTables(estimates, biases [][]float64) error {
+	if len(estimates) != len(rawEstimateData) || len(biases) != len(rawEstimateData) {
+		return fmt.Errorf("bias tables must have %d precisions, got %d and %d", len(rawEstimateData), len(estimates), len(biases))
+	}
+	for i, est := range estimates {
+		p := i + minPrecision
+		if len(est) == 0 || len(est) != len(biases[i]) {
+			return fmt.Errorf("bias tables for precision %d must have the same nonzero length, got %d and %d", p, len(est), len(biases[i]))
+		}
+	}
+	return nil
+}
+
+// defaultPrecision is the precision used by NewDefault, which is also the one
+// used by Redis.
+const defaultPrecision = 14
+
+// NewDefault returns a new initialized HyperLogLog64 of precision 14, the
+// precision used by Redis. Its standard error is about 0.8% and its registers
+// take 16 KB.
+func NewDefault() *HyperLogLog64 {
+	h, _ := New64(defaultPrecision)
+	return h
+}
+
+// New64WithSeed returns a new initialized HyperLogLog64 whose AddBytes and
+// AddString use a hash derived from seed. The hash only depends on the seed and
+// the input, so sketches built with the same seed from the same inputs are
+// identical in every process, while sketches with different seeds place the
+// same input in unrelated registers and are refused by Merge with
+// ErrSeedMismatch. A zero seed is the default hash used by New64. The seed is
+// recorded by MarshalBinary, but not by GobEncode.
+func New64WithSeed(precision uint8, seed uint64, opts ...Option) (*HyperLogLog64, error) {
+	h, err := New64(precision, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.seed = seed
 	return h, nil
 }
 
+// FromRegisters returns a HyperLogLog64 of the given precision that uses reg as
+// its registers. The slice is not copied, so the caller must not modify it
+// while the sketch is in use. This avoids a copy when loading large sketches,
+// e.g. from a memory-mapped file.
+func FromRegisters(precision uint8, reg []uint8) (*HyperLogLog64, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
+	}
+	if len(reg) != 1<<precision {
+		return nil, fmt.Errorf("%w: %d requires %d registers, got %d", ErrInvalidPrecision, precision, 1<<precision, len(reg))
+	}
+
+	h := &HyperLogLog64{}
+	h.p = precision
+	h.m = 1 << precision
+	h.reg = reg
+	h.registersChanged()
+	return h, nil
+}
+
+func checkPrecision64(precision uint8) error {
+	maxPrecision := len(rawEstimateData) + minPrecision - 1
+	if precision > uint8(maxPrecision) || precision < minPrecision {
+		return fmt.Errorf("%w: must be between %d and %d", ErrInvalidPrecision, minPrecision, maxPrecision)
+	}
+	return nil
+}
+
+// Registers returns the registers of HyperLogLog64 h. The slice is shared with
+// h and must not be modified.
+func (h *HyperLogLog64) Registers() []uint8 {
+	return h.reg
+}
+
+// Equal reports whether HyperLogLog64 h and other have the same precision,
+// seed and registers. Options and merge metadata are not compared.
+func (h *HyperLogLog64) Equal(other *HyperLogLog64) bool {
+	return h.p == other.p && h.seed == other.seed && bytes.Equal(h.reg, other.reg)
+}
+
+// Fingerprint returns a hash of the precision, seed and registers of
+// HyperLogLog64 h, the content compared by Equal. Equal sketches share a
+// fingerprint in every process, while different ones almost never do, so it
+// is a cheap pre-filter for finding duplicates among many sketches, to be
+// confirmed with Equal.
+func (h *HyperLogLog64) Fingerprint() uint64 {
+	return hashBytesSeed(h.reg, fmix64(h.seed)^uint64(h.p))
+}
+
+// Validate checks that HyperLogLog64 h is consistent: its precision is in
+// range, it has 2^p registers and none of them exceeds the largest possible
+// rank of 65-p. It is meant for sketches built from untrusted data, e.g. with
+// FromRegisters, where a register above the maximum indicates corruption or a
+// merge of sketches with different precisions. The error names the first
+// offending register.
+func (h *HyperLogLog64) Validate() error {
+	if err := checkDecoded(h.p, uint8(len(rawEstimateData)+minPrecision-1), h.m, h.reg, true); err != nil {
+		return err
+	}
+	maxRank := maxRank64(h.p)
+	for i, r := range h.reg {
+		if r > maxRank {
+			return fmt.Errorf("%w: register %d has rank %d, above the maximum %d for precision %d", ErrInvalidEncoding, i, r, maxRank, h.p)
+		}
+	}
+	return nil
+}
+
+// SizeBytes returns the approximate memory used by HyperLogLog64 h, the size
+// of its registers.
+func (h *HyperLogLog64) SizeBytes() int {
+	return len(h.reg)
+}
+
+// Snapshot is a copy of the state of a HyperLogLog64 taken by
+// HyperLogLog64.Snapshot.
+type Snapshot struct {
+	reg []uint8
+	p   uint8
+}
+
+// Snapshot returns a copy of the state of HyperLogLog64 h, which can be passed
+// to Restore to undo later changes.
+func (h *HyperLogLog64) Snapshot() Snapshot {
+	return Snapshot{reg: append([]uint8(nil), h.reg...), p: h.p}
+}
+
+// Restore sets HyperLogLog64 h back to the state in s, which must have been
+// returned by Snapshot. s is not modified, so it can be restored again.
+func (h *HyperLogLog64) Restore(s Snapshot) {
+	h.p = s.p
+	h.m = 1 << s.p
+	h.reg = append(h.reg[:0], s.reg...)
+	h.registersChanged()
+}
+
+// Diff returns the registers of HyperLogLog64 h that are greater than those
+// of base, encoded as the precision followed by a varint index delta and rank
+// for each of them. Registers never decrease, so applying the diff to a copy
+// of base with ApplyDiff reproduces h when base is an earlier state of h.
+func (h *HyperLogLog64) Diff(base *HyperLogLog64) ([]byte, error) {
+	if h.p != base.p {
+		return nil, ErrPrecisionMismatch
+	}
+
+	d := []byte{h.p}
+	last := 0
+	for i, v := range h.reg {
+		if v > base.reg[i] {
+			d = binary.AppendUvarint(d, uint64(i-last))
+			d = append(d, v)
+			last = i
+		}
+	}
+	return d, nil
+}
+
+// ApplyDiff raises the registers of HyperLogLog64 h to the values in d, which
+// must have been returned by Diff for a sketch of the same precision. The
+// whole diff is checked before any register is raised, so h is left unchanged
+// if it is invalid.
+func (h *HyperLogLog64) ApplyDiff(d []byte) error {
+	if len(d) == 0 {
+		return fmt.Errorf("%w: empty diff", ErrInvalidEncoding)
+	}
+	if d[0] != h.p {
+		return ErrPrecisionMismatch
+	}
+
+	maxRank := maxRank64(h.p)
+	if err := walkDiff(d[1:], h.m, func(i uint64, v uint8) error {
+		if v > maxRank {
+			return fmt.Errorf("%w: rank %d of register %d out of range", ErrInvalidEncoding, v, i)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	walkDiff(d[1:], h.m, func(i uint64, v uint8) error {
+		if v > h.reg[i] {
+			h.reg[i] = v
+		}
+		return nil
+	})
+	h.registersChanged()
+	return nil
+}
+
+// Calls f with the index and rank of each register in diff d, without its
+// precision byte, stopping at the first index delta that is truncated or
+// leads past the m registers, or at the first error returned by f.
+func walkDiff(d []byte, m uint32, f func(i uint64, v uint8) error) error {
+	i := uint64(0)
+	for len(d) > 0 {
+		delta, n := binary.Uvarint(d)
+		if n <= 0 || len(d) == n {
+			return fmt.Errorf("%w: truncated diff", ErrInvalidEncoding)
+		}
+		i += delta
+		if i >= uint64(m) {
+			return fmt.Errorf("%w: register index %d out of range", ErrInvalidEncoding, i)
+		}
+		if err := f(i, d[n]); err != nil {
+			return err
+		}
+		d = d[n+1:]
+	}
+	return nil
+}
+
 // Clear sets HyperLogLog64 h back to its initial state.
 func (h *HyperLogLog64) Clear() {
 	h.reg = make([]uint8, h.m)
+	h.nonZero = 0
+	h.tracking = false
+	h.merged, h.degraded = 0, false
+}
+
+// Swap returns a HyperLogLog64 holding the current state of HyperLogLog64 h,
+// including its options and merge metadata, and clears h. The registers are
+// handed over rather than copied, so a reporter can take the sketch of the
+// last interval and keep adding to h. It must not be called concurrently with
+// other methods of h.
+func (h *HyperLogLog64) Swap() *HyperLogLog64 {
+	old := *h
+	h.Clear()
+	return &old
+}
+
+// Updates the state derived from the registers of HyperLogLog64 h after they
+// were modified other than by raise.
+func (h *HyperLogLog64) registersChanged() {
+	h.nonZero = h.m - countZeros(h.reg)
+	h.tracking = false
 }
 
 // AddUint64 adds a new hash to HyperLogLog64 h.
 func (h *HyperLogLog64) AddUint64(x uint64) {
-	i := eb64(x, 64, 64-h.p) // {x63,...,x64-p}
-	w := x<<h.p | 1<<(h.p-1) // {x63-p,...,x0}
+	h.raise(indexRank64(x, h.p, maxRank64(h.p)))
+}
+
+// AddHash128 adds a new 128-bit hash, such as one computed with MurmurHash3
+// x64 128, to HyperLogLog64 h. The top bits of hi select the register and the
+// rank is computed from lo, so that the two are independent, rather than
+// taken from the same 64 bits as in AddUint64. Ranks are capped at the
+// largest rank AddUint64 can produce.
+func (h *HyperLogLog64) AddHash128(hi, lo uint64) {
+	i := eb64(hi, 64, 64-h.p) // {hi63,...,hi64-p}
+	h.raise(i, min(clz64(lo)+1, maxRank64(h.p)))
+}
+
+// SetRegister raises register index of HyperLogLog64 h to rank, as if a hash
+// with that index and rank had been added. It never lowers a register. It is
+// meant for building sketches with known registers in tests of estimators.
+// It panics if index or rank is out of range for the precision of h.
+func (h *HyperLogLog64) SetRegister(index uint32, rank uint8) {
+	if index >= h.m || rank > maxRank64(h.p) {
+		panic(fmt.Sprintf("hyperloglog: register %d or rank %d out of range", index, rank))
+	}
+	h.raise(uint64(index), rank)
+}
 
-	zeroBits := clz64(w) + 1
-	if zeroBits > h.reg[i] {
+// Raises register i of HyperLogLog64 h to rank zeroBits.
+func (h *HyperLogLog64) raise(i uint64, zeroBits uint8) {
+	if !h.validRegister(i) {
+		return
+	}
+	if r := h.reg[i]; zeroBits > r {
+		if r == 0 {
+			h.nonZero++
+		}
+		if h.tracking {
+			h.runSum += math.Ldexp(1, -int(zeroBits)) - math.Ldexp(1, -int(r))
+		}
 		h.reg[i] = zeroBits
 	}
 }
 
+// reconcileInterval is the number of calls to AddAndEstimate after which the
+// running sum is recomputed from the registers, bounding rounding errors.
+const reconcileInterval = 1 << 16
+
+// AddAndEstimate adds a new hash to HyperLogLog64 h and returns the
+// cardinality estimate afterwards. Rather than scanning the registers like
+// Count, it keeps a running sum and zero count that AddUint64 updates when a
+// register changes. The running sum accumulates floating point rounding
+// errors, so it is recomputed from the registers every reconcileInterval
+// calls and after h is modified other than by adding, e.g. by Merge. The
+// estimate may therefore differ slightly from Count.
+func (h *HyperLogLog64) AddAndEstimate(x uint64) uint64 {
+	if !h.tracking || h.runAdds >= reconcileInterval {
+		h.runSum = registerSum(h.reg)
+		h.runAdds = 0
+		h.tracking = true
+	}
+
+	h.AddUint64(x)
+	h.runAdds++
+	n, _ := h.estimateFrom(h.runSum, h.m-h.nonZero)
+	return n
+}
+
+// AddBytes hashes b and adds it to HyperLogLog64 h.
+func (h *HyperLogLog64) AddBytes(b []byte) {
+	h.AddUint64(hashBytesSeed(b, h.seed))
+}
+
+// AddString hashes s and adds it to HyperLogLog64 h. It is equivalent to
+// AddBytes([]byte(s)), but does not allocate.
+func (h *HyperLogLog64) AddString(s string) {
+	// The bytes of s are only read while hashing and the slice does not
+	// outlive this call, so it is safe to not copy them. unsafe.StringData
+	// may return nil for an empty string, which unsafe.Slice accepts for a
+	// length of zero.
+	h.AddBytes(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
 // SeenUint64 checks whether an uint64 has been seen already (probabilistically).
 func (h *HyperLogLog64) SeenUint64(x uint64) bool {
-	i := eb64(x, 64, 64-h.p) // {x63,...,x64-p}
-	w := x<<h.p | 1<<(h.p-1) // {x63-p,...,x0}
+	i, zeroBits := indexRank64(x, h.p, maxRank64(h.p))
+	return h.validRegister(i) && zeroBits <= h.reg[i]
+}
+
+// AddIfAbsent adds a new hash to HyperLogLog64 h and reports whether it was
+// absent, that is whether SeenUint64 would have reported it as unseen before,
+// finding the register and rank of x only once. Like SeenUint64 it never
+// reports an added hash as absent, but a new hash whose register already holds
+// its rank is reported as present, which becomes likely once h holds more
+// items than a small fraction of its m registers.
+func (h *HyperLogLog64) AddIfAbsent(x uint64) bool {
+	i, zeroBits := indexRank64(x, h.p, maxRank64(h.p))
+	if !h.validRegister(i) || zeroBits <= h.reg[i] {
+		return false
+	}
+	h.raise(i, zeroBits)
+	return true
+}
+
+// SeenMany reports for each of xs whether SeenUint64 would report it as seen,
+// checking the whole batch in a single call.
+func (h *HyperLogLog64) SeenMany(xs []uint64) []bool {
+	seen := make([]bool, len(xs))
+	maxRank := maxRank64(h.p)
+	for j, x := range xs {
+		i, zeroBits := indexRank64(x, h.p, maxRank)
+		seen[j] = h.validRegister(i) && zeroBits <= h.reg[i]
+	}
+	return seen
+}
+
+// SeenConfidence returns a heuristic probability that x was added to
+// HyperLogLog64 h. It is 0 if SeenUint64 reports x as unseen. Otherwise it is
+// the probability that the register x maps to did not reach the rank of x
+// through the other items alone, assuming Count items were added. It does not
+// account for hash collisions or the error of the count.
+func (h *HyperLogLog64) SeenConfidence(x uint64) float64 {
+	i, zeroBits := indexRank64(x, h.p, maxRank64(h.p))
+	if !h.validRegister(i) || zeroBits > h.reg[i] {
+		return 0
+	}
 
-	zeroBits := clz64(w) + 1
-	return zeroBits <= h.reg[i]
+	others := float64(h.Count())
+	if others > 0 {
+		others--
+	}
+	// Another item reaches the register with probability 1/m and a rank of
+	// at least zeroBits with probability 2^(1-zeroBits).
+	q := math.Ldexp(1, 1-int(zeroBits)) / float64(h.m)
+	return math.Pow(1-q, others)
 }
 
 // Merge takes another HyperLogLog64 and combines it with HyperLogLog64 h.
 func (h *HyperLogLog64) Merge(other *HyperLogLog64) error {
 	if h.p != other.p {
-		return errors.New("precisions must be equal")
+		return ErrPrecisionMismatch
+	}
+	if h.seed != other.seed {
+		return ErrSeedMismatch
 	}
 
+	h.addSources(other)
 	for i, v := range other.reg {
 		if v > h.reg[i] {
 			h.reg[i] = v
 		}
 	}
+	h.registersChanged()
+	return nil
+}
+
+// MergeWithOverlap combines other with HyperLogLog64 h like Merge and also
+// returns the inclusion-exclusion estimate of the size of the intersection of
+// the two sets, from the counts of both sketches before the merge and of h
+// after it. Like IntersectMany, the estimate carries the error of the counts,
+// which is large compared to a small overlap.
+func (h *HyperLogLog64) MergeWithOverlap(other *HyperLogLog64) (overlapEstimate uint64, err error) {
+	if h.p != other.p {
+		return 0, ErrPrecisionMismatch
+	}
+	if h.seed != other.seed {
+		return 0, ErrSeedMismatch
+	}
+
+	before := h.Count() + other.Count()
+	h.Merge(other)
+	if union := h.Count(); before > union {
+		return before - union, nil
+	}
+	return 0, nil
+}
+
+// MergeCounting combines other with HyperLogLog64 h like Merge and also
+// returns the number of registers of h it raised. Zero means other added
+// nothing new to h, e.g. so that a replica syncing with others does not need
+// to propagate the merge.
+func (h *HyperLogLog64) MergeCounting(other *HyperLogLog64) (changed int, err error) {
+	if h.p != other.p {
+		return 0, ErrPrecisionMismatch
+	}
+	if h.seed != other.seed {
+		return 0, ErrSeedMismatch
+	}
+
+	h.addSources(other)
+	for i, v := range other.reg {
+		if v > h.reg[i] {
+			h.reg[i] = v
+			changed++
+		}
+	}
+	if changed > 0 {
+		h.registersChanged()
+	}
+	return changed, nil
+}
+
+// MergeFold combines another HyperLogLog64 of any precision with
+// HyperLogLog64 h. If the precisions differ, the registers of the sketch of
+// higher precision are folded to the lower one first, so the precision of h
+// may be lowered. The result is then marked as degraded in its Metadata.
+func (h *HyperLogLog64) MergeFold(other *HyperLogLog64) error {
+	if h.seed != other.seed {
+		return ErrSeedMismatch
+	}
+	if h.p == other.p {
+		return h.Merge(other)
+	}
+
+	reg := other.reg
+	if other.p > h.p {
+		reg = foldRegisters(other.reg, other.p, h.p)
+	} else {
+		h.reg = foldRegisters(h.reg, h.p, other.p)
+		h.p, h.m = other.p, 1<<other.p
+	}
+
+	h.addSources(other)
+	h.degraded = true
+	for i, v := range reg {
+		if v > h.reg[i] {
+			h.reg[i] = v
+		}
+	}
+	h.registersChanged()
+	return nil
+}
+
+// Metadata describes where the data in a HyperLogLog64 came from. It is not
+// preserved by GobEncode or MarshalBinary.
+type Metadata struct {
+	// Sources is the number of sketches combined into the sketch by merging,
+	// including itself.
+	Sources int
+	// Degraded is set once the sketch or a sketch merged into it had its
+	// precision lowered by MergeFold.
+	Degraded bool
+}
+
+// Metadata returns the Metadata of HyperLogLog64 h.
+func (h *HyperLogLog64) Metadata() Metadata {
+	return Metadata{Sources: h.merged + 1, Degraded: h.degraded}
+}
+
+// Records that other was merged into h.
+func (h *HyperLogLog64) addSources(other *HyperLogLog64) {
+	h.merged += other.merged + 1
+	h.degraded = h.degraded || other.degraded
+}
+
+// MergeMany combines all of others with HyperLogLog64 h in a single pass over
+// the registers. h is not modified if any precision or seed differs from that
+// of h.
+func (h *HyperLogLog64) MergeMany(others ...*HyperLogLog64) error {
+	for _, other := range others {
+		if h.p != other.p {
+			return ErrPrecisionMismatch
+		}
+		if h.seed != other.seed {
+			return ErrSeedMismatch
+		}
+	}
+
+	for _, other := range others {
+		h.addSources(other)
+	}
+	for i, v := range h.reg {
+		for _, other := range others {
+			v = max(v, other.reg[i])
+		}
+		h.reg[i] = v
+	}
+	h.registersChanged()
 	return nil
 }
 
 // Count returns the cardinality estimate.
 func (h *HyperLogLog64) Count() uint64 {
-	est := calculateEstimate(h.reg)
-	if est <= float64(h.m)*5.0 {
+	n, _ := h.estimate()
+	return n
+}
+
+// boundSigmas is the number of standard errors between the estimate and the
+// bounds returned by CountLowerBound and CountUpperBound.
+const boundSigmas = 3
+
+// CountLowerBound returns a conservative lower bound of the cardinality of
+// HyperLogLog64 h: the estimate minus three times its expected standard
+// error, which the true cardinality falls below only rarely.
+func (h *HyperLogLog64) CountLowerBound() uint64 {
+	n, delta := h.bound()
+	if delta >= float64(n) {
+		return 0
+	}
+	return uint64(math.Floor(float64(n) - delta))
+}
+
+// CountUpperBound returns a conservative upper bound of the cardinality of
+// HyperLogLog64 h: the estimate plus three times its expected standard error,
+// which the true cardinality exceeds only rarely.
+func (h *HyperLogLog64) CountUpperBound() uint64 {
+	n, delta := h.bound()
+	return uint64(math.Ceil(float64(n) + delta))
+}
+
+// Returns the estimate of h and its distance to the bounds, allowing one
+// more for the rounding of the estimate.
+func (h *HyperLogLog64) bound() (uint64, float64) {
+	n := h.Count()
+	return n, boundSigmas*expectedError(h.p, n)*float64(n) + 1
+}
+
+// ScaleCount returns the cardinality estimate of HyperLogLog64 h multiplied
+// by factor, e.g. 10 for a sketch of a 10% sample of a stream. Sketches of
+// samples taken the same way can be merged first. The relative error of the
+// result is that of the estimate plus that of the sampling, which is large
+// when few distinct items were sampled. For the factor to apply to distinct
+// items, the sample must select items by their hash rather than per event.
+func (h *HyperLogLog64) ScaleCount(factor float64) uint64 {
+	return uint64(math.Round(float64(h.Count()) * factor))
+}
+
+// CountParallel returns the cardinality estimate like Count, splitting the
+// pass over the registers between the given number of goroutines. This only
+// pays off for large precisions. The partial sums are added in a different
+// order than by Count, so the two may differ by a rounding error.
+func (h *HyperLogLog64) CountParallel(workers int) uint64 {
+	if workers <= 1 {
+		return h.Count()
+	}
+
+	sums := make([]float64, workers)
+	zeros := make([]uint32, workers)
+	chunk := (len(h.reg) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := min(w*chunk, len(h.reg))
+		end := min(start+chunk, len(h.reg))
+		wg.Add(1)
+		go func(w int, s []uint8) {
+			defer wg.Done()
+			sums[w] = registerSum(s)
+			zeros[w] = countZeros(s)
+		}(w, h.reg[start:end])
+	}
+	wg.Wait()
+
+	var sum float64
+	var z uint32
+	for w := range sums {
+		sum += sums[w]
+		z += zeros[w]
+	}
+	n, _ := h.estimateFrom(sum, z)
+	return n
+}
+
+// Computes the cardinality estimate and reports whether it was obtained using
+// linear counting.
+func (h *HyperLogLog64) estimate() (uint64, bool) {
+	return h.estimateFrom(registerSum(h.reg), h.m-h.nonZero)
+}
+
+// Computes the cardinality estimate from the sum of 2^-r over all registers r
+// and the number of zero registers.
+func (h *HyperLogLog64) estimateFrom(sum float64, zeros uint32) (uint64, bool) {
+	est, lc := h.rawEstimateFrom(sum, zeros)
+	return h.round(est), lc
+}
+
+// Like estimateFrom, but returns the estimate before rounding.
+func (h *HyperLogLog64) rawEstimateFrom(sum float64, zeros uint32) (float64, bool) {
+	a := alpha
+	if h.alpha != nil {
+		a = h.alpha
+	}
+
+	fm := float64(h.m)
+	est := a(h.m) * fm * fm / sum
+	if est <= fm*5.0 {
 		est -= h.estimateBias(est)
 	}
 
-	if v := countZeros(h.reg); v != 0 {
-		lc := linearCounting(h.m, v)
+	if zeros != 0 {
+		lc := linearCounting(uint64(h.m), uint64(zeros))
 		if lc <= float64(threshold[h.p-4]) {
-			return uint64(lc)
+			return lc, true
 		}
 	}
+	return est, false
+}
+
+// Converts estimate est to an integer using the rounding mode of h.
+func (h *HyperLogLog64) round(est float64) uint64 {
+	if h.rounding == RoundNearest {
+		est = math.Round(est)
+	}
 	return uint64(est)
 }
 
+// Summary describes the state of a HyperLogLog64.
+type Summary struct {
+	Precision        uint8
+	Registers        uint32
+	NonZeroRegisters uint32
+	MaxRank          uint8
+	EstimatedCount   uint64
+	// EstimatedError is the relative standard error of the estimate,
+	// 1.04/sqrt(Registers).
+	EstimatedError float64
+	// LinearCounting is true if EstimatedCount was obtained using linear
+	// counting rather than the bias corrected HyperLogLog estimate.
+	LinearCounting bool
+}
+
+// Summary returns a Summary of HyperLogLog64 h, e.g. for logging. It does not
+// modify h.
+func (h *HyperLogLog64) Summary() Summary {
+	s := Summary{
+		Precision:        h.p,
+		Registers:        h.m,
+		NonZeroRegisters: h.nonZero,
+		MaxRank:          h.MaxRank(),
+		EstimatedError:   1.04 / math.Sqrt(float64(h.m)),
+	}
+	s.EstimatedCount, s.LinearCounting = h.estimate()
+	return s
+}
+
+// UsingLinearCounting reports whether Count of HyperLogLog64 h currently
+// returns the linear counting estimate, taken from the number of zero
+// registers, rather than the bias corrected HyperLogLog estimate. Linear
+// counting is used while some registers are zero and its estimate is below the
+// threshold for the precision of h, so it switches off as the cardinality
+// grows.
+func (h *HyperLogLog64) UsingLinearCounting() bool {
+	_, lc := h.estimate()
+	return lc
+}
+
+// MaxRank returns the largest register value of HyperLogLog64 h. For n
+// distinct items it is rarely much above log2(n/m)+log2(m)+1 = log2(n)+1; a
+// much larger value suggests a poor hash function or corrupted registers.
+func (h *HyperLogLog64) MaxRank() uint8 {
+	var r uint8
+	for _, v := range h.reg {
+		r = max(r, v)
+	}
+	return r
+}
+
+// MinNonZeroRank returns the smallest nonzero register value of HyperLogLog64
+// h, or 0 if h is empty.
+func (h *HyperLogLog64) MinNonZeroRank() uint8 {
+	var r uint8
+	for _, v := range h.reg {
+		if v != 0 && (r == 0 || v < r) {
+			r = v
+		}
+	}
+	return r
+}
+
+// CountAtPrecision returns the cardinality estimate HyperLogLog64 h would have
+// if it had been built with the lower precision p. h is not modified.
+func (h *HyperLogLog64) CountAtPrecision(p uint8) (uint64, error) {
+	if p > h.p {
+		return 0, fmt.Errorf("%w: must not be greater than %d", ErrInvalidPrecision, h.p)
+	}
+
+	folded, err := FromRegisters(p, foldRegisters(h.reg, h.p, p))
+	if err != nil {
+		return 0, err
+	}
+	folded.alpha, folded.rounding = h.alpha, h.rounding
+	folded.estTables, folded.biasTables = h.estTables, h.biasTables
+	return folded.Count(), nil
+}
+
+// UpscaleTo returns a HyperLogLog64 of the higher precision p made from
+// HyperLogLog64 h, for pipelines that only handle sketches of precision p.
+//
+// The result is an approximation and must be treated as such: h does not
+// record the hashes that would tell the registers at precision p apart, so
+// its error is that of h or worse, never the lower error of precision p, and
+// it is marked as degraded in its Metadata. Items added to it or merged into
+// it later are counted normally.
+//
+// Each register of h stands for a block of 2^(p-h.p) registers of the result.
+// While h holds few items for each block, the items of each register are
+// replaced by as many synthetic hashes, the estimated count of h divided by
+// its nonzero registers, one of them with the rank of the register and the
+// others with a lower or equal one, so the count of the result stays close to
+// that of h. The hashes are derived deterministically, so that upscaling the
+// same sketch always gives the same result. With more items, every register
+// of the block gets the rank of the register lowered by p-h.p, the rank their
+// maxima have on average, which keeps the estimate unchanged.
+func (h *HyperLogLog64) UpscaleTo(p uint8) (*HyperLogLog64, error) {
+	if err := checkPrecision64(p); err != nil {
+		return nil, err
+	}
+	if p < h.p {
+		return nil, fmt.Errorf("%w: must not be lower than %d", ErrInvalidPrecision, h.p)
+	}
+
+	u := h.Clone()
+	if p == h.p {
+		return u, nil
+	}
+	u.p, u.m = p, 1<<p
+	u.reg = make([]uint8, u.m)
+	u.tracking = false
+	u.degraded = true
+	if h.nonZero == 0 {
+		return u, nil
+	}
+
+	d := p - h.p
+	block := 1 << d
+	perRegister := float64(h.Count()) / float64(h.nonZero)
+	if perRegister >= 4*float64(block) {
+		for j, r := range h.reg {
+			if r != 0 {
+				v := max(r-min(r, d), 1)
+				for k := 0; k < block; k++ {
+					u.reg[j<<d|k] = v
+				}
+			}
+		}
+		u.registersChanged()
+		return u, nil
+	}
+
+	// Synthetic hashes are the remaining q bits of each hash at precision h.p,
+	// drawn from a counter mixed with fmix64.
+	var c uint64
+	next := func() uint64 {
+		c++
+		return fmix64(c)
+	}
+	q := 64 - h.p
+	maxRank := maxRank64(h.p)
+	for j, r := range h.reg {
+		if r == 0 {
+			continue
+		}
+		top := uint64(j) << q
+
+		n := int(perRegister)
+		if float64(next()>>11)/(1<<53) < perRegister-float64(n) {
+			n++
+		}
+
+		// The first hash has the rank of the register exactly.
+		w := uint64(0)
+		if r <= q {
+			w = (next()>>h.p | 1<<(q-1)) >> (r - 1)
+		}
+		u.AddUint64(top | w)
+		for i := 1; i < n; i++ {
+			for {
+				w := next() >> h.p
+				if _, rank := indexRank64(top|w, h.p, maxRank); rank <= r {
+					u.AddUint64(top | w)
+					break
+				}
+			}
+		}
+	}
+	u.registersChanged()
+	return u, nil
+}
+
+// Folds registers of precision from into registers of the lower precision to.
+// The result is the same as if the hashes had been added at precision to.
+func foldRegisters(reg []uint8, from, to uint8) []uint8 {
+	d := from - to
+	folded := make([]uint8, 1<<to)
+	for i, r := range reg {
+		if r == 0 {
+			continue
+		}
+
+		// The d low bits of the index are the leading bits of w at
+		// precision to.
+		if low := uint32(i) & (1<<d - 1); low != 0 {
+			r = clz32(low) - (32 - d) + 1
+		} else {
+			r += d
+		}
+		if j := i >> d; r > folded[j] {
+			folded[j] = r
+		}
+	}
+	return folded
+}
+
 // Estimates the bias using empirically determined values.
 func (h *HyperLogLog64) estimateBias(est float64) float64 {
 	estTable, biasTable := rawEstimateData[h.p-4], biasData[h.p-4]
+	if h.estTables != nil {
+		estTable, biasTable = h.estTables[h.p-4], h.biasTables[h.p-4]
+	}
 
 	if estTable[0] > est {
 		return biasTable[0]
@@ -136,6 +1007,8 @@ func (h *HyperLogLog64) GobEncode() ([]byte, error) {
 // GobDecode decodes gob into a HyperLogLog64 structure.
 func (h *HyperLogLog64) GobDecode(b []byte) error {
 	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	h.merged, h.degraded = 0, false
+	defer h.registersChanged()
 	if err := dec.Decode(&h.reg); err != nil {
 		return err
 	}
@@ -145,5 +1018,197 @@ func (h *HyperLogLog64) GobDecode(b []byte) error {
 	if err := dec.Decode(&h.p); err != nil {
 		return err
 	}
+	return checkDecoded(h.p, uint8(len(rawEstimateData)+minPrecision-1), h.m, h.reg, true)
+}
+
+// binaryVersion is the version of the format written by
+// HyperLogLog64.MarshalBinary.
+const binaryVersion = 1
+
+// Flags of the binary format.
+const (
+	// binaryFlagSeed is set when the header is followed by the 8-byte
+	// big-endian hash seed.
+	binaryFlagSeed = 1 << 0
+
+	// binaryFlagRLE is set when runs of zero registers are run-length
+	// encoded, each as a zero byte followed by the uvarint length of the run.
+	binaryFlagRLE = 1 << 1
+)
+
+// MarshalBinary encodes HyperLogLog64 h as a version byte, the precision and a
+// flags byte, followed by the seed if h has one, and then the registers. The
+// registers are stored one byte each, or with runs of zero registers
+// run-length encoded if that is smaller, as for mostly empty sketches of a
+// high precision.
+func (h *HyperLogLog64) MarshalBinary() ([]byte, error) {
+	return h.AppendTo(make([]byte, 0, 11+len(h.reg))), nil
+}
+
+// AppendTo appends the encoding of HyperLogLog64 h produced by MarshalBinary to
+// dst and returns the extended slice, so that many sketches can be written to
+// one reused buffer without allocating.
+func (h *HyperLogLog64) AppendTo(dst []byte) []byte {
+	var flags byte
+	if h.seed != 0 {
+		flags |= binaryFlagSeed
+	}
+	rle := rleLen(h.reg) < len(h.reg)
+	if rle {
+		flags |= binaryFlagRLE
+	}
+
+	dst = append(dst, binaryVersion, h.p, flags)
+	if h.seed != 0 {
+		dst = binary.BigEndian.AppendUint64(dst, h.seed)
+	}
+	if rle {
+		return appendRLE(dst, h.reg)
+	}
+	return append(dst, h.reg...)
+}
+
+// Returns the length of the run-length encoding of registers reg.
+func rleLen(reg []uint8) int {
+	var n int
+	for i := 0; i < len(reg); {
+		if reg[i] != 0 {
+			n++
+			i++
+			continue
+		}
+		j := i
+		for j < len(reg) && reg[j] == 0 {
+			j++
+		}
+		n += 1 + uvarintLen(uint64(j-i))
+		i = j
+	}
+	return n
+}
+
+// Appends the run-length encoding of registers reg to dst.
+func appendRLE(dst []byte, reg []uint8) []byte {
+	for i := 0; i < len(reg); {
+		if reg[i] != 0 {
+			dst = append(dst, reg[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(reg) && reg[j] == 0 {
+			j++
+		}
+		dst = append(dst, 0)
+		dst = binary.AppendUvarint(dst, uint64(j-i))
+		i = j
+	}
+	return dst
+}
+
+// Decodes the run-length encoding of m registers in data.
+func decodeRLE(data []byte, m uint32) ([]uint8, error) {
+	reg := make([]uint8, 0, m)
+	for len(data) > 0 {
+		if data[0] != 0 {
+			reg = append(reg, data[0])
+			data = data[1:]
+			continue
+		}
+		n, k := binary.Uvarint(data[1:])
+		if k <= 0 || n == 0 || n > uint64(int(m)-len(reg)) {
+			return nil, fmt.Errorf("%w: bad run of zero registers", ErrInvalidEncoding)
+		}
+		reg = reg[:len(reg)+int(n)]
+		data = data[1+k:]
+	}
+	return reg, nil
+}
+
+// Returns the length of the uvarint encoding of x.
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// UnmarshalBinary decodes data produced by MarshalBinary into HyperLogLog64 h.
+func (h *HyperLogLog64) UnmarshalBinary(data []byte) error {
+	p, seed, reg, err := parseBinary(data)
+	if err != nil {
+		return err
+	}
+
+	h.p = p
+	h.seed = seed
+	h.m = 1 << p
+	h.reg = append(h.reg[:0], reg...)
+	h.merged, h.degraded = 0, false
+	h.registersChanged()
+	return nil
+}
+
+// MergeBytes combines the sketch encoded in data by MarshalBinary with
+// HyperLogLog64 h, reading the registers directly from data rather than
+// decoding them into an intermediate sketch.
+func (h *HyperLogLog64) MergeBytes(data []byte) error {
+	p, seed, reg, err := parseBinary(data)
+	if err != nil {
+		return err
+	}
+	if p != h.p {
+		return ErrPrecisionMismatch
+	}
+	if seed != h.seed {
+		return ErrSeedMismatch
+	}
+
+	h.merged++
+	for i, v := range reg {
+		if v > h.reg[i] {
+			h.reg[i] = v
+		}
+	}
+	h.registersChanged()
 	return nil
 }
+
+// Validates data produced by HyperLogLog64.MarshalBinary and returns the
+// precision, the seed and the registers, which are a subslice of data unless
+// they were run-length encoded.
+func parseBinary(data []byte) (uint8, uint64, []uint8, error) {
+	if len(data) < 3 {
+		return 0, 0, nil, fmt.Errorf("%w: header too short", ErrInvalidEncoding)
+	}
+	if data[0] != binaryVersion {
+		return 0, 0, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, data[0])
+	}
+	p := data[1]
+	if err := checkPrecision64(p); err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: %w", ErrInvalidEncoding, err)
+	}
+	flags, rest := data[2], data[3:]
+	if flags&^(binaryFlagSeed|binaryFlagRLE) != 0 {
+		return 0, 0, nil, fmt.Errorf("%w: unsupported flags %#x", ErrInvalidEncoding, flags)
+	}
+
+	var seed uint64
+	if flags&binaryFlagSeed != 0 {
+		if len(rest) < 8 {
+			return 0, 0, nil, fmt.Errorf("%w: seed too short", ErrInvalidEncoding)
+		}
+		seed, rest = binary.BigEndian.Uint64(rest), rest[8:]
+	}
+	if flags&binaryFlagRLE != 0 {
+		var err error
+		if rest, err = decodeRLE(rest, 1<<p); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	if err := checkDecoded(p, p, 1<<p, rest, true); err != nil {
+		return 0, 0, nil, err
+	}
+	return p, seed, rest, nil
+}
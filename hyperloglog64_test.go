@@ -1,7 +1,12 @@
 package hyperloglog
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"fmt"
+	"math"
+	"math/bits"
 	"math/rand"
 	"testing"
 
@@ -114,3 +119,1064 @@ func TestHLL64Seen(t *testing.T) {
 		})
 	}
 }
+
+func TestHLL64SeenMany(t *testing.T) {
+	h, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	xs := make([]uint64, 1e5)
+	for i := range xs {
+		xs[i] = r.Uint64()
+		if i%2 == 0 {
+			h.AddUint64(xs[i])
+		}
+	}
+
+	seen := h.SeenMany(xs)
+	require.Len(t, seen, len(xs))
+	for i, x := range xs {
+		require.Equal(t, h.SeenUint64(x), seen[i])
+	}
+	require.Empty(t, h.SeenMany(nil))
+}
+
+func BenchmarkHLL64SeenMany(b *testing.B) {
+	h, _ := New64(14)
+	xs := make([]uint64, 1e6)
+	for i := range xs {
+		xs[i] = rand.Uint64()
+		if i%2 == 0 {
+			h.AddUint64(xs[i])
+		}
+	}
+
+	b.Run("SeenUint64", func(b *testing.B) {
+		seen := make([]bool, len(xs))
+		for i := 0; i < b.N; i++ {
+			for j, x := range xs {
+				seen[j] = h.SeenUint64(x)
+			}
+		}
+	})
+	b.Run("SeenMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.SeenMany(xs)
+		}
+	})
+}
+
+func TestHLL64FromRegisters(t *testing.T) {
+	h, err := New64(14)
+	require.NoError(t, err)
+	for i := 0; i < 1e5; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+
+	h2, err := FromRegisters(14, h.Registers())
+	require.NoError(t, err)
+	require.Equal(t, h, h2)
+	require.Equal(t, h.Count(), h2.Count())
+
+	_, err = FromRegisters(14, make([]uint8, 1<<13))
+	require.Error(t, err)
+
+	_, err = FromRegisters(3, make([]uint8, 1<<3))
+	require.Error(t, err)
+}
+
+func TestHLL64Summary(t *testing.T) {
+	reg := make([]uint8, 16)
+	reg[1], reg[5], reg[9] = 1, 7, 3
+	h, err := FromRegisters(4, reg)
+	require.NoError(t, err)
+
+	s := h.Summary()
+	require.Equal(t, Summary{
+		Precision:        4,
+		Registers:        16,
+		NonZeroRegisters: 3,
+		MaxRank:          7,
+		EstimatedCount:   h.Count(),
+		EstimatedError:   0.26,
+		LinearCounting:   true,
+	}, s)
+	require.Equal(t, []uint8{0, 1, 0, 0, 0, 7, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0}, h.reg)
+
+	for i := range reg {
+		reg[i] = 10
+	}
+	h, _ = FromRegisters(4, reg)
+	s = h.Summary()
+	require.False(t, s.LinearCounting)
+	require.Equal(t, uint32(16), s.NonZeroRegisters)
+}
+
+func TestHLL64CountAtPrecision(t *testing.T) {
+	h, _ := New64(14)
+	for _, p := range []uint8{14, 10, 4} {
+		h2, _ := New64(p)
+		h.Clear()
+		for i := 0; i < 1e5; i++ {
+			x := rand.Uint64()
+			h.AddUint64(x)
+			h2.AddUint64(x)
+		}
+		reg := append([]uint8(nil), h.reg...)
+
+		require.Equal(t, h2.reg, foldRegisters(h.reg, 14, p))
+		n, err := h.CountAtPrecision(p)
+		require.NoError(t, err)
+		require.Equal(t, h2.Count(), n)
+		require.Equal(t, reg, h.reg)
+	}
+
+	_, err := h.CountAtPrecision(15)
+	require.Error(t, err)
+	_, err = h.CountAtPrecision(3)
+	require.Error(t, err)
+}
+
+func TestHLL64AddString(t *testing.T) {
+	h, _ := New64(14)
+	h2, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		s := randStr(i)
+		h.AddString(s)
+		h2.AddBytes([]byte(s))
+	}
+	h.AddString("")
+	h2.AddBytes(nil)
+
+	require.Equal(t, h2.reg, h.reg)
+	require.InEpsilon(t, 1e4+1, h.Count(), 0.02)
+}
+
+func TestHLL64WithBiasTables(t *testing.T) {
+	zeros := make([][]float64, len(biasData))
+	for i, b := range biasData {
+		zeros[i] = make([]float64, len(b))
+	}
+
+	h, err := New64(14, WithBiasTables(rawEstimateData, zeros))
+	require.NoError(t, err)
+	def, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 30000; i++ {
+		x := r.Uint64()
+		h.AddUint64(x)
+		def.AddUint64(x)
+	}
+
+	// Above the linear counting threshold, but in the range where Count
+	// corrects the bias of the raw estimate.
+	raw := calculateEstimate(h.reg)
+	require.Equal(t, uint64(raw), h.Count())
+	require.Equal(t, uint64(raw-def.estimateBias(raw)), def.Count())
+	require.NotEqual(t, def.Count(), h.Count())
+
+	_, err = New64(14, WithBiasTables(rawEstimateData, zeros[1:]))
+	require.Error(t, err)
+	zeros[3] = zeros[3][1:]
+	_, err = New64(14, WithBiasTables(rawEstimateData, zeros))
+	require.Error(t, err)
+}
+
+func TestHLL64Swap(t *testing.T) {
+	h, _ := New64(14, WithRounding(RoundNearest))
+	first, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e4; i++ {
+		x := r.Uint64()
+		h.AddUint64(x)
+		first.AddUint64(x)
+	}
+
+	swapped := h.Swap()
+	require.Zero(t, h.Count())
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(r.Uint64())
+	}
+
+	require.Equal(t, first.reg, swapped.reg)
+	require.Equal(t, RoundNearest, swapped.rounding)
+	require.NotEqual(t, first.reg, h.reg)
+	require.InEpsilon(t, 1e4, h.Count(), 0.02)
+}
+
+func TestHLL64NewDefault(t *testing.T) {
+	h := NewDefault()
+	require.Equal(t, uint8(14), h.p)
+	require.Len(t, h.reg, 16384)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	require.InEpsilon(t, 1e5, h.Count(), 0.03)
+}
+
+func TestHLL64Validate(t *testing.T) {
+	h, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	require.NoError(t, h.Validate())
+
+	reg := append([]uint8(nil), h.reg...)
+	reg[100] = 52
+	bad, _ := FromRegisters(14, reg)
+	err := bad.Validate()
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+	require.EqualError(t, err, "invalid encoding: register 100 has rank 52, above the maximum 51 for precision 14")
+
+	bad.reg = bad.reg[:10]
+	require.ErrorIs(t, bad.Validate(), ErrInvalidEncoding)
+}
+
+func TestHLL64WithSeed(t *testing.T) {
+	a, _ := New64WithSeed(14, 42)
+	b, _ := New64WithSeed(14, 42)
+	c, _ := New64WithSeed(14, 43)
+	d, _ := New64WithSeed(14, 0)
+	e, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		s := randStr(i)
+		for _, h := range []*HyperLogLog64{a, b, c, d, e} {
+			h.AddString(s)
+		}
+	}
+
+	require.True(t, a.Equal(b))
+	require.False(t, a.Equal(c))
+	require.True(t, d.Equal(e))
+	require.InEpsilon(t, 1e4, c.Count(), 0.02)
+
+	// The seed survives a round trip through the binary format.
+	buf, err := a.MarshalBinary()
+	require.NoError(t, err)
+	var a2 HyperLogLog64
+	require.NoError(t, a2.UnmarshalBinary(buf))
+	require.True(t, a.Equal(&a2))
+	a2.AddString("x")
+	b.AddString("x")
+	require.True(t, b.Equal(&a2))
+
+	require.ErrorIs(t, a2.UnmarshalBinary(buf[:10]), ErrInvalidEncoding)
+}
+
+func TestHLL64Fingerprint(t *testing.T) {
+	a, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		a.AddString(randStr(i))
+	}
+	b := a.Clone()
+	require.Equal(t, a.Fingerprint(), b.Fingerprint())
+
+	b.AddUint64(0) // register 0, the highest rank
+	require.False(t, a.Equal(b))
+	require.NotEqual(t, a.Fingerprint(), b.Fingerprint())
+
+	// Empty sketches differ by precision and seed.
+	e14, _ := New64(14)
+	e15, _ := New64(15)
+	s14, _ := New64WithSeed(14, 1)
+	require.NotEqual(t, e14.Fingerprint(), e15.Fingerprint())
+	require.NotEqual(t, e14.Fingerprint(), s14.Fingerprint())
+}
+
+func TestHLL64AddIfAbsent(t *testing.T) {
+	h, _ := New64(18)
+	plain, _ := New64(18)
+	r := rand.New(rand.NewSource(1))
+	xs := make([]uint64, 2000)
+	for i := range xs {
+		xs[i] = r.Uint64()
+	}
+
+	// Each hash is added three times; only its first addition can be absent.
+	absent := 0
+	for pass := 0; pass < 3; pass++ {
+		for _, x := range xs {
+			if h.AddIfAbsent(x) {
+				require.Zero(t, pass)
+				absent++
+			}
+			plain.AddUint64(x)
+			require.True(t, h.SeenUint64(x))
+		}
+	}
+	require.InEpsilon(t, len(xs), absent, 0.02)
+	require.True(t, h.Equal(plain))
+	require.Equal(t, plain.Count(), h.Count())
+}
+
+func TestHLL64UsingLinearCounting(t *testing.T) {
+	h, _ := New64(14)
+	require.True(t, h.UsingLinearCounting())
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	require.True(t, h.UsingLinearCounting())
+
+	// Past the threshold of 11500 for precision 14 the regular estimate is
+	// used.
+	for i := 0; i < 2e4; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	require.False(t, h.UsingLinearCounting())
+	require.Equal(t, h.Summary().LinearCounting, h.UsingLinearCounting())
+}
+
+func TestHLL64UpscaleTo(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	h, _ := New64(10)
+	added := 0
+	for _, n := range []int{100, 1000, 5000, 20000, 1e5, 1e6} {
+		for ; added < n; added++ {
+			h.AddUint64(r.Uint64())
+		}
+		for _, p := range []uint8{10, 11, 14} {
+			u, err := h.UpscaleTo(p)
+			require.NoError(t, err)
+			require.Equal(t, p, u.Precision())
+			require.InEpsilon(t, h.Count(), u.Count(), 0.1, "n=%d p=%d", n, p)
+			require.Equal(t, p > 10, u.Metadata().Degraded)
+			require.NoError(t, u.Validate())
+		}
+		same, _ := h.UpscaleTo(10)
+		require.True(t, h.Equal(same))
+	}
+
+	// The result is deterministic and keeps counting new items.
+	u1, _ := h.UpscaleTo(14)
+	u2, _ := h.UpscaleTo(14)
+	require.True(t, u1.Equal(u2))
+	before := u1.Count()
+	for i := 0; i < 1e6; i++ {
+		u1.AddUint64(r.Uint64())
+	}
+	require.InEpsilon(t, before+1e6, u1.Count(), 0.1)
+
+	empty, _ := New64(10)
+	u, err := empty.UpscaleTo(14)
+	require.NoError(t, err)
+	require.Zero(t, u.Count())
+
+	_, err = h.UpscaleTo(9)
+	require.ErrorIs(t, err, ErrInvalidPrecision)
+	_, err = h.UpscaleTo(19)
+	require.ErrorIs(t, err, ErrInvalidPrecision)
+}
+
+func TestHLL64MergeSeedMismatch(t *testing.T) {
+	a, _ := New64WithSeed(14, 42)
+	b, _ := New64WithSeed(14, 42)
+	c, _ := New64WithSeed(14, 43)
+	d, _ := New64(14)
+	for i := 0; i < 1e3; i++ {
+		s := randStr(i)
+		for _, h := range []*HyperLogLog64{a, b, c, d} {
+			h.AddString(s)
+		}
+	}
+
+	require.NoError(t, a.Merge(b))
+	require.ErrorIs(t, a.Merge(c), ErrSeedMismatch)
+	require.ErrorIs(t, a.Merge(d), ErrSeedMismatch)
+	require.ErrorIs(t, a.MergeMany(b, c), ErrSeedMismatch)
+	require.ErrorIs(t, a.MergeFold(c), ErrSeedMismatch)
+	_, err := a.MergeWithOverlap(c)
+	require.ErrorIs(t, err, ErrSeedMismatch)
+	buf, err := c.MarshalBinary()
+	require.NoError(t, err)
+	require.ErrorIs(t, a.MergeBytes(buf), ErrSeedMismatch)
+	require.True(t, a.Equal(b))
+
+	// Default sketches still merge among themselves.
+	e, _ := New64(14)
+	require.NoError(t, e.Merge(d))
+	require.True(t, e.Equal(d))
+}
+
+func BenchmarkHLL64AddString(b *testing.B) {
+	strs := make([]string, 1024)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("%064d", rand.Int63())
+	}
+	h, _ := New64(14)
+
+	b.Run("AddString", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.AddString(strs[i%len(strs)])
+		}
+	})
+	b.Run("AddBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h.AddBytes([]byte(strs[i%len(strs)]))
+		}
+	})
+}
+
+func TestHLL64SnapshotRestore(t *testing.T) {
+	h, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	n := h.Count()
+	reg := append([]uint8(nil), h.reg...)
+
+	s := h.Snapshot()
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	require.NotEqual(t, n, h.Count())
+
+	h.Restore(s)
+	require.Equal(t, n, h.Count())
+	require.Equal(t, reg, h.reg)
+
+	// Adds after a Restore must not change the snapshot.
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	h.Restore(s)
+	require.Equal(t, reg, h.reg)
+}
+
+func TestHLL64Diff(t *testing.T) {
+	h, _ := New64(14)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	base, _ := FromRegisters(14, append([]uint8(nil), h.reg...))
+
+	for i := 0; i < 1e3; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	d, err := h.Diff(base)
+	require.NoError(t, err)
+	require.Less(t, len(d), len(h.reg)/4)
+
+	require.NoError(t, base.ApplyDiff(d))
+	require.Equal(t, h.reg, base.reg)
+	require.Equal(t, h.Count(), base.Count())
+
+	other, _ := New64(10)
+	_, err = h.Diff(other)
+	require.ErrorIs(t, err, ErrPrecisionMismatch)
+	require.ErrorIs(t, other.ApplyDiff(d), ErrPrecisionMismatch)
+	require.ErrorIs(t, base.ApplyDiff(d[:len(d)-1]), ErrInvalidEncoding)
+
+	// A diff found invalid partway through leaves the sketch unchanged.
+	fresh, _ := FromRegisters(14, make([]uint8, 1<<14))
+	for _, bad := range [][]byte{
+		d[:len(d)-1],
+		append(append([]byte(nil), d...), 0xff, 0xff, 0x03, 1),
+		append(append([]byte(nil), d...), 1, maxRank64(14)+1),
+	} {
+		require.ErrorIs(t, fresh.ApplyDiff(bad), ErrInvalidEncoding)
+		require.Zero(t, fresh.Count())
+		require.Equal(t, make([]uint8, 1<<14), fresh.reg)
+	}
+
+	// A rank no hash can produce at this precision is rejected.
+	small, _ := New64(10)
+	require.ErrorIs(t, small.ApplyDiff([]byte{10, 5, 200}), ErrInvalidEncoding)
+	require.ErrorIs(t, small.ApplyDiff([]byte{10, 5, maxRank64(10) + 1}), ErrInvalidEncoding)
+	require.Equal(t, make([]uint8, 1<<10), small.reg)
+	require.NoError(t, small.ApplyDiff([]byte{10, 5, maxRank64(10)}))
+	require.Equal(t, maxRank64(10), small.reg[5])
+}
+
+func TestHLL64WithAlpha(t *testing.T) {
+	var got uint32
+	h, _ := New64(14, WithAlpha(func(m uint32) float64 {
+		got = m
+		return 2 * alpha(m)
+	}))
+	d, _ := New64(14)
+	for i := 0; i < 1e5; i++ {
+		x := rand.Uint64()
+		h.AddUint64(x)
+		d.AddUint64(x)
+	}
+
+	require.InDelta(t, 2*d.Count(), h.Count(), 1)
+	require.Equal(t, uint32(1<<14), got)
+}
+
+func TestHLL64CountParallel(t *testing.T) {
+	h, _ := New64(16)
+	for _, n := range []int{0, 1e3, 1e5} {
+		for i := 0; i < n; i++ {
+			h.AddUint64(rand.Uint64())
+		}
+		for _, workers := range []int{0, 1, 3, 8} {
+			require.InDelta(t, h.Count(), h.CountParallel(workers), 1, "n=%d workers=%d", n, workers)
+		}
+	}
+}
+
+func BenchmarkHLL64CountParallel(b *testing.B) {
+	h, _ := New64(18)
+	for i := 0; i < 1e6; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			c := uint64(0)
+			for i := 0; i < b.N; i++ {
+				c += h.CountParallel(workers)
+			}
+			require.NotZero(b, c)
+		})
+	}
+}
+
+func TestHLL64ScaleCount(t *testing.T) {
+	h, _ := New64(14)
+	const n = 1e6
+	for i := 0; i < n; i++ {
+		// Sample 10% of the items by hash.
+		if x := rand.Uint64(); x%10 == 0 {
+			h.AddUint64(x)
+		}
+	}
+	require.InEpsilon(t, n, h.ScaleCount(10), 0.05)
+}
+
+func TestHLL64GobCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(make([]uint8, 100)))
+	require.NoError(t, enc.Encode(uint32(1<<14)))
+	require.NoError(t, enc.Encode(uint8(14)))
+
+	var h HyperLogLog64
+	err := h.GobDecode(buf.Bytes())
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+	require.EqualError(t, err, "invalid encoding: 100 registers for precision 14")
+}
+
+func TestHLL64MarshalBinary(t *testing.T) {
+	h, _ := New64(12)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+
+	b, err := h.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, b, h.AppendTo(nil))
+	require.Equal(t, append([]byte("x"), b...), h.AppendTo([]byte("x")))
+
+	var h2 HyperLogLog64
+	require.NoError(t, h2.UnmarshalBinary(b))
+	require.Equal(t, h.reg, h2.reg)
+	require.Equal(t, h.Count(), h2.Count())
+
+	require.ErrorIs(t, h2.UnmarshalBinary(b[:2]), ErrInvalidEncoding)
+	require.ErrorIs(t, h2.UnmarshalBinary(b[:len(b)-1]), ErrInvalidEncoding)
+	b[0] = 2
+	require.ErrorIs(t, h2.UnmarshalBinary(b), ErrInvalidEncoding)
+}
+
+func TestHLL64MarshalBinaryRLE(t *testing.T) {
+	// A sketch of precision 16 holding few items is mostly zero registers.
+	h, _ := New64(16)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		h.AddUint64(r.Uint64())
+	}
+
+	b, err := h.MarshalBinary()
+	require.NoError(t, err)
+	raw := 3 + len(h.reg)
+	require.Equal(t, byte(binaryFlagRLE), b[2])
+	require.Less(t, len(b), raw/20)
+	t.Logf("raw: %d bytes, run-length encoded: %d bytes", raw, len(b))
+
+	var h2 HyperLogLog64
+	require.NoError(t, h2.UnmarshalBinary(b))
+	require.Equal(t, h.reg, h2.reg)
+	require.Equal(t, h.Count(), h2.Count())
+
+	h3, _ := New64(16)
+	require.NoError(t, h3.MergeBytes(b))
+	require.Equal(t, h.reg, h3.reg)
+
+	// An empty sketch is a single run, and a full one is stored raw.
+	empty, _ := New64(16)
+	b, _ = empty.MarshalBinary()
+	require.Len(t, b, 3+1+3)
+	for i := 0; i < 1e6; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	b, _ = h.MarshalBinary()
+	require.Equal(t, byte(0), b[2])
+	require.Len(t, b, raw)
+
+	// Runs must not overflow the registers.
+	bad := []byte{binaryVersion, 4, binaryFlagRLE, 0, 17}
+	require.ErrorIs(t, h2.UnmarshalBinary(bad), ErrInvalidEncoding)
+	bad = []byte{binaryVersion, 4, binaryFlagRLE, 0, 15}
+	require.ErrorIs(t, h2.UnmarshalBinary(bad), ErrInvalidEncoding)
+	require.NoError(t, h2.UnmarshalBinary(append(bad, 1)))
+}
+
+func BenchmarkHLL64Marshal(b *testing.B) {
+	hs := make([]*HyperLogLog64, 100)
+	for i := range hs {
+		hs[i], _ = New64(14)
+		for j := 0; j < 1e3; j++ {
+			hs[i].AddUint64(rand.Uint64())
+		}
+	}
+
+	b.Run("MarshalBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, h := range hs {
+				if _, err := h.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("AppendTo", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = buf[:0]
+			for _, h := range hs {
+				buf = h.AppendTo(buf)
+			}
+		}
+	})
+}
+
+func TestHLL64MergeMany(t *testing.T) {
+	hs := make([]*HyperLogLog64, 4)
+	want, _ := New64(12)
+	for i := range hs {
+		hs[i], _ = New64(12)
+		for j := 0; j < 1e3; j++ {
+			x := rand.Uint64()
+			hs[i].AddUint64(x)
+			want.AddUint64(x)
+		}
+	}
+
+	h, _ := New64(12)
+	require.NoError(t, h.MergeMany(hs...))
+	require.Equal(t, want.reg, h.reg)
+
+	other, _ := New64(13)
+	require.ErrorIs(t, h.MergeMany(hs[0], other), ErrPrecisionMismatch)
+}
+
+func TestHLL64RankExtremes(t *testing.T) {
+	h, _ := New64(4)
+	require.Zero(t, h.MaxRank())
+	require.Zero(t, h.MinNonZeroRank())
+
+	copy(h.reg, []uint8{0, 3, 0, 7, 2, 0, 12, 5})
+	require.Equal(t, uint8(12), h.MaxRank())
+	require.Equal(t, uint8(2), h.MinNonZeroRank())
+}
+
+func TestHLL64SizeBytes(t *testing.T) {
+	for _, p := range []uint8{4, 14, 18} {
+		h, _ := New64(p)
+		require.Equal(t, 1<<p, h.SizeBytes())
+	}
+}
+
+func TestHLL64WithRounding(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var changed int
+	for _, n := range []int{10, 100, 1000, 5000, 20000, 100000} {
+		tr, _ := New64(14)
+		rn, _ := New64(14, WithRounding(RoundNearest))
+		for i := 0; i < n; i++ {
+			x := r.Uint64()
+			tr.AddUint64(x)
+			rn.AddUint64(x)
+		}
+
+		est, _ := rn.rawEstimateFrom(registerSum(rn.reg), rn.m-rn.nonZero)
+		require.Equal(t, uint64(est), tr.Count())
+		require.Equal(t, uint64(math.Round(est)), rn.Count())
+		if tr.Count() != rn.Count() {
+			changed++
+		}
+	}
+	require.NotZero(t, changed)
+}
+
+func TestHLL64MergeBytes(t *testing.T) {
+	a, _ := New64(12)
+	b, _ := New64(12)
+	for i := 0; i < 1e4; i++ {
+		a.AddUint64(rand.Uint64())
+		b.AddUint64(rand.Uint64())
+	}
+	data, _ := b.MarshalBinary()
+
+	want, _ := FromRegisters(12, append([]uint8(nil), a.reg...))
+	require.NoError(t, want.Merge(b))
+	require.NoError(t, a.MergeBytes(data))
+	require.Equal(t, want.reg, a.reg)
+
+	c, _ := New64(13)
+	require.ErrorIs(t, c.MergeBytes(data), ErrPrecisionMismatch)
+	require.ErrorIs(t, a.MergeBytes(data[:10]), ErrInvalidEncoding)
+}
+
+func BenchmarkHLL64MergeBytes(b *testing.B) {
+	sketches := make([][]byte, 1000)
+	for i := range sketches {
+		h, _ := New64(16)
+		for j := 0; j < 1e3; j++ {
+			h.AddUint64(rand.Uint64())
+		}
+		sketches[i], _ = h.MarshalBinary()
+	}
+
+	b.Run("MergeBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		h, _ := New64(16)
+		for i := 0; i < b.N; i++ {
+			for _, data := range sketches {
+				if err := h.MergeBytes(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("UnmarshalMerge", func(b *testing.B) {
+		b.ReportAllocs()
+		h, _ := New64(16)
+		for i := 0; i < b.N; i++ {
+			for _, data := range sketches {
+				var other HyperLogLog64
+				if err := other.UnmarshalBinary(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := h.Merge(&other); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestHLL64AddAndEstimate(t *testing.T) {
+	h, _ := New64(14)
+	for i := 1; i <= 2e5; i++ {
+		n := h.AddAndEstimate(rand.Uint64())
+		if i%1000 == 0 {
+			require.InEpsilon(t, h.Count(), n, 0.01, "i=%d", i)
+		}
+		if i%50000 == 0 {
+			// Changes other than adds must be picked up.
+			other, _ := New64(14)
+			for j := 0; j < 1e4; j++ {
+				other.AddUint64(rand.Uint64())
+			}
+			require.NoError(t, h.Merge(other))
+		}
+	}
+}
+
+func TestHLL64Metadata(t *testing.T) {
+	hs := make([]*HyperLogLog64, 3)
+	for i := range hs {
+		hs[i], _ = New64(12)
+		for j := 0; j < 1e3; j++ {
+			hs[i].AddUint64(rand.Uint64())
+		}
+	}
+	require.Equal(t, Metadata{Sources: 1}, hs[0].Metadata())
+
+	require.NoError(t, hs[0].Merge(hs[1]))
+	require.NoError(t, hs[0].Merge(hs[2]))
+	require.Equal(t, Metadata{Sources: 3}, hs[0].Metadata())
+
+	u, _ := New64(14)
+	require.NoError(t, u.MergeFold(hs[0]))
+	require.Equal(t, Metadata{Sources: 4, Degraded: true}, u.Metadata())
+	require.Equal(t, uint8(12), u.p)
+	require.Equal(t, hs[0].reg, u.reg)
+
+	u.Clear()
+	require.Equal(t, Metadata{Sources: 1}, u.Metadata())
+
+	// Decoding replaces the sketch, so it forgets what was merged into it.
+	data, err := hs[1].MarshalBinary()
+	require.NoError(t, err)
+	gobData, err := hs[1].GobEncode()
+	require.NoError(t, err)
+	for _, decode := range []func(*HyperLogLog64) error{
+		func(h *HyperLogLog64) error { return h.UnmarshalBinary(data) },
+		func(h *HyperLogLog64) error { return h.GobDecode(gobData) },
+	} {
+		d, _ := New64(14)
+		require.NoError(t, d.MergeFold(hs[0]))
+		require.Equal(t, Metadata{Sources: 4, Degraded: true}, d.Metadata())
+		require.NoError(t, decode(d))
+		require.Equal(t, Metadata{Sources: 1}, d.Metadata())
+		require.Equal(t, hs[1].reg, d.reg)
+	}
+}
+
+func TestHLL64MergeWithOverlap(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(14)
+	u, _ := New64(14)
+	// a = [0, 60000) and b = [40000, 100000) overlap in 20000 items.
+	for i := uint64(0); i < 100000; i++ {
+		x := fmix64(i)
+		if i < 60000 {
+			a.AddUint64(x)
+		}
+		if i >= 40000 {
+			b.AddUint64(x)
+		}
+		u.AddUint64(x)
+	}
+
+	overlap, err := a.MergeWithOverlap(b)
+	require.NoError(t, err)
+	require.InEpsilon(t, 20000, overlap, 0.1)
+	require.Equal(t, u.reg, a.reg)
+
+	c, _ := New64(12)
+	_, err = a.MergeWithOverlap(c)
+	require.ErrorIs(t, err, ErrPrecisionMismatch)
+}
+
+func TestHLL64MergeCounting(t *testing.T) {
+	a, _ := New64(10)
+	b, _ := New64(10)
+	for i := uint64(0); i < 3000; i++ {
+		a.AddUint64(fmix64(i))
+		b.AddUint64(fmix64(i + 2000))
+	}
+
+	want := 0
+	for i, v := range b.reg {
+		if v > a.reg[i] {
+			want++
+		}
+	}
+	require.NotZero(t, want)
+	u := a.Clone()
+	require.NoError(t, u.Merge(b))
+
+	changed, err := a.MergeCounting(b)
+	require.NoError(t, err)
+	require.Equal(t, want, changed)
+	require.Equal(t, u.reg, a.reg)
+	require.Equal(t, u.Count(), a.Count())
+
+	changed, err = a.MergeCounting(b)
+	require.NoError(t, err)
+	require.Zero(t, changed)
+
+	c, _ := New64(12)
+	_, err = a.MergeCounting(c)
+	require.ErrorIs(t, err, ErrPrecisionMismatch)
+}
+
+func TestHLL64MergeFold(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(12)
+	want, _ := New64(12)
+	for i := 0; i < 1e4; i++ {
+		x, y := rand.Uint64(), rand.Uint64()
+		a.AddUint64(x)
+		b.AddUint64(y)
+		want.AddUint64(x)
+		want.AddUint64(y)
+	}
+
+	require.NoError(t, b.MergeFold(a))
+	require.Equal(t, want.reg, b.reg)
+	require.True(t, b.Metadata().Degraded)
+}
+
+// murmur3Sum128 returns the MurmurHash3 x64 128 hash of b with seed 0.
+func murmur3Sum128(b []byte) (uint64, uint64) {
+	return murmur3Sum128Seed(b, 0)
+}
+
+// murmur3Sum128Seed returns the MurmurHash3 x64 128 hash of b with the given
+// seed.
+func murmur3Sum128Seed(b []byte, seed uint64) (uint64, uint64) {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	h1, h2 := seed, seed
+	n := len(b)
+	for ; len(b) >= 16; b = b[16:] {
+		k1 := binary.LittleEndian.Uint64(b)
+		k2 := binary.LittleEndian.Uint64(b[8:])
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+		h1 = (bits.RotateLeft64(h1, 27)+h2)*5 + 0x52dce729
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+		h2 = (bits.RotateLeft64(h2, 31)+h1)*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := len(b) - 1; i >= 8; i-- {
+		k2 = k2<<8 | uint64(b[i])
+	}
+	for i := min(len(b), 8) - 1; i >= 0; i-- {
+		k1 = k1<<8 | uint64(b[i])
+	}
+	if len(b) > 8 {
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+	}
+	if len(b) > 0 {
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1, h2 = fmix64(h1), fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+func TestMurmur3Sum128(t *testing.T) {
+	// Reference values from the C++ implementation.
+	for _, tc := range []struct {
+		in     string
+		h1, h2 uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{"The quick brown fox jumps over the lazy dog", 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	} {
+		h1, h2 := murmur3Sum128([]byte(tc.in))
+		require.Equal(t, tc.h1, h1, tc.in)
+		require.Equal(t, tc.h2, h2, tc.in)
+	}
+}
+
+func TestHLL64AddHash128(t *testing.T) {
+	h, _ := New64(14)
+	const n = 1e5
+	for i := 0; i < n; i++ {
+		h.AddHash128(murmur3Sum128([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	require.InEpsilon(t, n, h.Count(), 3*1.04/math.Sqrt(1<<14))
+
+	// x = 0 has the highest rank in either case.
+	h.AddHash128(0, 0)
+	require.Equal(t, maxRank64(14), h.reg[0])
+}
+
+func TestHLL64NonZero(t *testing.T) {
+	h, _ := New64(10)
+	check := func() {
+		t.Helper()
+		require.Equal(t, h.m-countZeros(h.reg), h.nonZero)
+	}
+	check()
+
+	for i := 0; i < 500; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+	check()
+
+	other, _ := New64(10)
+	for i := 0; i < 500; i++ {
+		other.AddUint64(rand.Uint64())
+	}
+	require.NoError(t, h.Merge(other))
+	check()
+
+	h.AddHash128(rand.Uint64(), rand.Uint64())
+	check()
+
+	h.Clear()
+	check()
+	require.Zero(t, h.Count())
+}
+
+func TestHLL64SetRegister(t *testing.T) {
+	h, _ := New64(14)
+	m := float64(h.m)
+
+	// With every register at rank r the raw estimate is alpha*m*2^r.
+	for i := uint32(0); i < h.m; i++ {
+		h.SetRegister(i, 10)
+	}
+	require.InDelta(t, alpha(h.m)*m*1024, h.Count(), 1)
+
+	// Registers are never lowered.
+	h.SetRegister(0, 3)
+	require.Equal(t, uint8(10), h.reg[0])
+
+	// With a quarter of the registers at rank 1 and the rest empty, the
+	// estimate is that of linear counting.
+	h.Clear()
+	for i := uint32(0); i < h.m/4; i++ {
+		h.SetRegister(i, 1)
+	}
+	require.Equal(t, uint64(m*math.Log(m/(m*3/4))), h.Count())
+
+	require.Panics(t, func() { h.SetRegister(h.m, 1) })
+	require.Panics(t, func() { h.SetRegister(0, 52) })
+}
+
+func TestHLL64CountBounds(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, p := range []uint8{10, 14} {
+		h, _ := New64(p)
+		added := 0
+		for _, n := range []int{0, 10, 100, 1000, 1e4, 1e5, 1e6} {
+			for ; added < n; added++ {
+				h.AddUint64(r.Uint64())
+			}
+
+			lower, upper := h.CountLowerBound(), h.CountUpperBound()
+			require.LessOrEqual(t, lower, h.Count())
+			require.GreaterOrEqual(t, upper, h.Count())
+			require.LessOrEqual(t, lower, uint64(n), "p=%d n=%d", p, n)
+			require.GreaterOrEqual(t, upper, uint64(n), "p=%d n=%d", p, n)
+		}
+	}
+}
+
+func TestHLL64SeenConfidence(t *testing.T) {
+	h, _ := New64(14)
+	added := make([]uint64, 1e5)
+	for i := range added {
+		added[i] = rand.Uint64()
+		h.AddUint64(added[i])
+	}
+
+	var seen, unseen float64
+	for _, x := range added[:1e4] {
+		c := h.SeenConfidence(x)
+		require.True(t, c > 0 && c <= 1, c)
+		seen += c
+	}
+	for range added[:1e4] {
+		x := rand.Uint64()
+		c := h.SeenConfidence(x)
+		require.Equal(t, h.SeenUint64(x), c > 0)
+		unseen += c
+	}
+	t.Logf("average confidence: added %0.3f, unseen %0.3f", seen/1e4, unseen/1e4)
+	require.Greater(t, seen, unseen)
+
+	empty, _ := New64(14)
+	require.Zero(t, empty.SeenConfidence(added[0]))
+}
@@ -3,6 +3,9 @@ package hyperloglog
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"math"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -72,6 +75,24 @@ func TestHLLCount(t *testing.T) {
 	}
 }
 
+func TestHLLCountAccuracy(t *testing.T) {
+	var h *HyperLogLog32
+	h, _ = New(14)
+
+	r := rand.New(rand.NewSource(1))
+	const n = 500000
+	for i := 0; i < n; i++ {
+		h.Add(fakeHash32(r.Uint32()))
+	}
+
+	// The standard error is 1.04/sqrt(m); allow four of them, plus the
+	// handful of hash collisions expected in the 32-bit space.
+	got := float64(h.Count())
+	if e := math.Abs(got-n) / n; e > 4*1.04/math.Sqrt(1<<14) {
+		t.Error(got, e)
+	}
+}
+
 func TestHLLMergeError(t *testing.T) {
 	h, _ := New(16)
 	h2, _ := New(10)
@@ -202,3 +223,26 @@ func TestHLLGob(t *testing.T) {
 		t.Error("unmarshaled structure differs")
 	}
 }
+
+func TestHLLGobCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		reg []uint8
+		m   uint32
+		p   uint8
+	}{
+		{make([]uint8, 16), 16, 5},
+		{make([]uint8, 8), 16, 4},
+		{make([]uint8, 1<<5), 1 << 5, 30},
+	} {
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		enc.Encode(tc.reg)
+		enc.Encode(tc.m)
+		enc.Encode(tc.p)
+
+		var h HyperLogLog
+		if err := h.GobDecode(buf.Bytes()); !errors.Is(err, ErrInvalidEncoding) {
+			t.Error(tc.p, err)
+		}
+	}
+}
@@ -4,11 +4,24 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"sort"
+	"sync/atomic"
 )
 
+// pPrime is the default and largest precision of the sparse representation.
+// Sparse keys of the form index<<7 | rank<<1 | 1 must fit 32 bits.
 const pPrime = 25
-const mPrime = 1 << (pPrime - 1)
+
+// explicitThreshold is the default number of distinct hashes a HyperLogLogPlus
+// stores exactly before switching to the sparse representation.
+const explicitThreshold = 64
+
+// sparseInitialCapacity is the number of bytes initially allocated for the
+// sparse list, which grows as needed rather than reserving m bytes upfront.
+const sparseInitialCapacity = 64
 
 var threshold = []uint{
 	10, 20, 40, 80, 220, 400, 900, 1800, 3100,
@@ -22,14 +35,54 @@ type HyperLogLogPlus struct {
 	sparse     bool
 	tmpSet     set
 	sparseList *compressedList
+
+	// sparseP is the precision of the sparse representation, between p+1
+	// and pPrime. initSparseP is the one h was created with, which Clear
+	// restores after folding, or 0 if unknown.
+	sparseP     uint8
+	initSparseP uint8
+
+	// While explicit, the raw hashes added to h are kept sorted in explicitSet
+	// and counted exactly. Explicit sketches are also sparse.
+	explicit      bool
+	explicitSet   []uint64
+	explicitLimit int
+
+	// maxSparseBytes is the size beyond which the sparse list is folded to
+	// a lower sparse precision, or 0 to never fold it.
+	maxSparseBytes int
+
+	// normalThreshold is the size in bytes beyond which the sparse list is
+	// converted to the normal representation, or 0 for m.
+	normalThreshold int
+
+	// initP is the precision h was created with, which Clear restores after
+	// NewAdaptive or WithMaxSparseBytes changed it, or 0 if unknown. A
+	// sketch created by NewAdaptive raises its precision while sparse up to
+	// maxP, which is 0 otherwise.
+	initP, maxP uint8
+
+	// compensated makes Count sum the registers with compensated summation.
+	compensated bool
+
+	// blendOffset is the difference between the sparse and normal estimates
+	// when h was converted to the normal representation by adding to it, and
+	// blendBase the normal estimate then, or 0 if h was not.
+	blendOffset float64
+	blendBase   float64
+
+	// count caches the result of Count plus one until h is next modified,
+	// or is 0. It is atomic so that concurrent calls to Count can fill it.
+	count atomic.Uint64
 }
 
 // Encode a hash to be used in the sparse representation.
 func (h *HyperLogLogPlus) encodeHash(x uint64) uint32 {
-	idx := uint32(eb64(x, 64, 64-pPrime))
+	sp := h.sparseP
+	idx := uint32(eb64(x, 64, 64-sp))
 
-	if eb64(x, 64-h.p, 64-pPrime) == 0 {
-		zeros := clz64((eb64(x, 64-pPrime, 0)<<pPrime)|(1<<pPrime-1)) + 1
+	if eb64(x, 64-h.p, 64-sp) == 0 {
+		zeros := clz64((eb64(x, 64-sp, 0)<<sp)|(1<<sp-1)) + 1
 		return idx<<7 | uint32(zeros<<1) | 1
 	}
 	return idx << 1
@@ -38,32 +91,49 @@ func (h *HyperLogLogPlus) encodeHash(x uint64) uint32 {
 // Get the index of precision p from the sparse representation.
 func (h *HyperLogLogPlus) getIndex(k uint32) uint32 {
 	if k&1 == 1 {
-		return eb32(k, 32, 32-h.p)
+		return eb32(k, h.sparseP+7, h.sparseP+7-h.p)
 	}
-	return eb32(k, pPrime+1, pPrime-h.p+1)
+	return eb32(k, h.sparseP+1, h.sparseP-h.p+1)
 }
 
 // Decode a hash from the sparse representation.
 func (h *HyperLogLogPlus) decodeHash(k uint32) (uint32, uint8) {
 	var r uint8
 	if k&1 == 1 {
-		r = uint8(eb32(k, 7, 1)) + pPrime - h.p
+		r = uint8(eb32(k, 7, 1)) + h.sparseP - h.p
 	} else {
-		r = clz32(k<<(32-pPrime+h.p-1)) + 1
+		r = clz32(k<<(32-h.sparseP+h.p-1)) + 1
 	}
 	return h.getIndex(k), r
 }
 
-// Merge tmpSet and sparseList in the sparse representation.
-// Converts to normal if the sparse list is too large
+// Merge tmpSet and sparseList in the sparse representation, then apply the
+// promotions that follow, e.g. converting to normal if the list is too large.
 func (h *HyperLogLogPlus) mergeSparse() {
+	h.flushSparse()
+	h.promote()
+}
+
+// Merges tmpSet into sparseList without changing the representation.
+func (h *HyperLogLogPlus) flushSparse() {
 	keys := make(sortableSlice, 0, len(h.tmpSet))
 	for k := range h.tmpSet {
 		keys = append(keys, k)
 	}
 	sort.Sort(keys)
 
-	newList := newCompressedList(int(h.m))
+	// If all new keys sort after the tail of the list they can be appended
+	// to it, avoiding a rebuild of the whole list.
+	if len(keys) > 0 && (h.sparseList.Count == 0 || keys[0] > h.sparseList.last) {
+		for _, k := range keys {
+			h.sparseList.Append(k)
+		}
+		h.tmpSet.Clear()
+		return
+	}
+
+	// Each key takes at most 5 bytes, but most take one or two.
+	newList := newCompressedList(min(int(h.m), h.sparseList.Len()+2*len(keys)))
 	for iter, i := h.sparseList.Iter(), 0; iter.HasNext() || i < len(keys); {
 		if !iter.HasNext() {
 			newList.Append(keys[i])
@@ -89,11 +159,107 @@ func (h *HyperLogLogPlus) mergeSparse() {
 	}
 
 	h.sparseList = newList
-	h.tmpSet = set{}
+	h.tmpSet.Clear()
+}
 
-	if uint32(h.sparseList.Len()) > h.m {
-		h.toNormal()
+// A promotion is a change of representation of a HyperLogLogPlus.
+type promotion int
+
+const (
+	promoteNone    promotion = iota
+	promoteSparse            // convert the explicit set to sparse
+	promoteFlush             // merge pending hashes into the sparse list
+	promoteFold              // lower the sparse precision by one
+	promoteShrink            // lower the precision by one
+	promoteCompact           // keep one key for each sparse register
+	promoteGrow              // raise the precision by one
+	promoteNormal            // convert the sparse list to normal
+)
+
+// Returns the next promotion of HyperLogLogPlus h, following a ladder that
+// only ever goes down: an explicit set larger than explicitLimit becomes
+// sparse and more pending hashes than m/100 are merged into the sparse list.
+// With maxSparseBytes, h never becomes normal: a list larger than it is
+// folded while the sparse precision is above the precision, the precision
+// is lowered after that, and at the lowest precision the list is reduced to
+// one key for each sparse register, which always fits. Otherwise a list
+// larger than the normal threshold, m bytes by default, or with the default
+// threshold and sparse precision one holding more keys than
+// OptimalSparseCutoff, raises the precision of a sketch created by
+// NewAdaptive up to its maximum and then makes h normal. No step turns a
+// sketch back into an earlier representation or raises its sparse precision,
+// and a sketch whose precision is lowered never raises it, so the
+// representations never alternate.
+func (h *HyperLogLogPlus) nextPromotion() promotion {
+	switch {
+	case h.explicit:
+		if len(h.explicitSet) > h.explicitLimit {
+			return promoteSparse
+		}
+	case h.sparse:
+		if uint32(len(h.tmpSet))*100 > h.m {
+			return promoteFlush
+		}
+		n, limit := h.sparseList.Len(), h.sparseLimit()
+		if h.maxSparseBytes > 0 {
+			switch {
+			case n <= limit:
+			case h.sparseP > h.p+1:
+				return promoteFold
+			case h.p > minPlusPrecision:
+				return promoteShrink
+			default:
+				return promoteCompact
+			}
+			return promoteNone
+		}
+		if n > limit || h.pastSparseCutoff() {
+			if h.p < h.maxP && h.p+1 < h.sparseP {
+				return promoteGrow
+			}
+			return promoteNormal
+		}
+	}
+	return promoteNone
+}
+
+// Applies the promotions chosen by nextPromotion to HyperLogLogPlus h until
+// none is left.
+func (h *HyperLogLogPlus) promote() {
+	for {
+		switch h.nextPromotion() {
+		case promoteSparse:
+			h.toSparse()
+		case promoteFlush:
+			h.flushSparse()
+		case promoteFold:
+			h.foldSparse(h.sparseP - 1)
+		case promoteShrink:
+			h.rebuildSparse(h.p - 1)
+		case promoteCompact:
+			h.rebuildSparse(h.p)
+		case promoteGrow:
+			h.reencode(h.p + 1)
+			h.flushSparse()
+		case promoteNormal:
+			h.toNormalBlended()
+		default:
+			return
+		}
+	}
+}
+
+// Returns the size in bytes beyond which the sparse list of HyperLogLogPlus h
+// is folded or lowered in precision when h has a sparse byte budget, and
+// converted to the normal representation otherwise.
+func (h *HyperLogLogPlus) sparseLimit() int {
+	if h.maxSparseBytes > 0 {
+		return h.maxSparseBytes
 	}
+	if h.normalThreshold > 0 {
+		return h.normalThreshold
+	}
+	return int(h.m)
 }
 
 func (h *HyperLogLogPlus) mergeSparseAndToNormal() {
@@ -103,34 +269,218 @@ func (h *HyperLogLogPlus) mergeSparseAndToNormal() {
 	}
 }
 
+// A PlusOption configures a HyperLogLogPlus created by NewPlus.
+type PlusOption func(*HyperLogLogPlus)
+
+// WithExplicitThreshold sets the number of distinct hashes a HyperLogLogPlus
+// stores and counts exactly before switching to the sparse representation. A
+// threshold of 0 makes it start out sparse. It is not preserved by GobEncode.
+func WithExplicitThreshold(n int) PlusOption {
+	return func(h *HyperLogLogPlus) {
+		h.explicitLimit = n
+	}
+}
+
+// WithCompensatedSum makes Count add up the registers of a normal
+// HyperLogLogPlus with compensated summation. At high precisions the terms of
+// small registers grow the plain floating-point sum enough for it to drop the
+// low-order bits of the terms of large registers; the compensated sum keeps
+// them, at the cost of a slower Count. The effect on the estimate is far below
+// its standard error. It is not preserved by GobEncode.
+func WithCompensatedSum() PlusOption {
+	return func(h *HyperLogLogPlus) {
+		h.compensated = true
+	}
+}
+
+// WithSparsePrecision sets the precision of the sparse representation, which
+// must be greater than the precision of the sketch and at most 25, the
+// default. Lower sparse precisions make the sparse representation smaller and
+// less accurate. Sparse sketches of different sparse precisions are merged by
+// converting the receiver to the normal representation.
+func WithSparsePrecision(sp uint8) PlusOption {
+	return func(h *HyperLogLogPlus) {
+		h.sparseP = sp
+	}
+}
+
+// WithMaxSparseBytes keeps the sparse list of a HyperLogLogPlus within n
+// bytes, which must be at least 64, and never converts it to the normal
+// representation. Whenever the list grows larger it is SparseFold-ed to a
+// lower sparse precision, and once the sparse precision is one above the
+// precision, the precision itself is lowered, down to 4, where the list is
+// reduced to one key for each of the 32 sparse registers. Each bit of sparse
+// precision given up doubles the hashes that share a sparse register, so the
+// sparse estimate loses accuracy as the sketch grows while its memory stays
+// bounded, and each bit of precision given up also doubles the error of the
+// estimate once it no longer uses linear counting. Clear restores both
+// precisions. Merging folds the receiver or the keys merged into it to the
+// lower of their sparse precisions; sketches of different precisions cannot
+// be merged, and neither can normal ones into the receiver. A sketch created
+// by NewAdaptive with it does not raise its precision. It is not preserved by
+// GobEncode.
+func WithMaxSparseBytes(n int) PlusOption {
+	return func(h *HyperLogLogPlus) {
+		h.maxSparseBytes = n
+	}
+}
+
+// WithNormalThreshold sets the size in bytes beyond which the sparse list of a
+// HyperLogLogPlus is converted to the normal representation. The default is
+// m, the size of the normal registers; a larger threshold keeps sketches
+// sparse, and their estimates more accurate, for longer at the cost of memory.
+// It has no effect with WithMaxSparseBytes, which keeps the list sparse. It is
+// not preserved by GobEncode.
+func WithNormalThreshold(n int) PlusOption {
+	return func(h *HyperLogLogPlus) {
+		h.normalThreshold = n
+	}
+}
+
 // NewPlus returns a new initialized HyperLogLogPlus that uses the HyperLogLog++
-// algorithm.
-func NewPlus(precision uint8) (*HyperLogLogPlus, error) {
+// algorithm. It starts out storing the added hashes exactly, switches to the
+// sparse representation once there are more than a few dozen, and to the
+// normal one when the sparse representation is no longer smaller.
+func NewPlus(precision uint8, opts ...PlusOption) (*HyperLogLogPlus, error) {
 	if precision > 18 || precision < 4 {
-		return nil, errors.New("precision must be between 4 and 18")
+		return nil, fmt.Errorf("%w: must be between 4 and 18", ErrInvalidPrecision)
 	}
 
 	h := &HyperLogLogPlus{}
 	h.p = precision
 	h.m = 1 << precision
-	h.sparse = true
-	h.tmpSet = set{}
-	h.sparseList = newCompressedList(int(h.m))
+	h.explicitLimit = explicitThreshold
+	h.sparseP = pPrime
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.sparseP <= h.p || h.sparseP > pPrime {
+		return nil, fmt.Errorf("%w: sparse precision must be between %d and %d", ErrInvalidPrecision, h.p+1, pPrime)
+	}
+	if h.maxSparseBytes != 0 && h.maxSparseBytes < minSparseBytes {
+		return nil, fmt.Errorf("sparse byte budget must be at least %d", minSparseBytes)
+	}
+	h.initP, h.initSparseP = h.p, h.sparseP
+	h.Clear()
 	return h, nil
 }
 
-// Clear sets HyperLogLogPlus h back to its initial state.
+// NewAdaptive returns a new initialized HyperLogLogPlus for streams of unknown
+// cardinality. It starts out at precision minP and, whenever its sparse list
+// outgrows the normal representation, raises the precision by one as
+// Reprecision does instead, until it reaches maxP and converts to the normal
+// representation, whose precision is then fixed. Small streams thus take
+// little memory while large ones get the accuracy of maxP. Sketches at
+// different precisions cannot be merged, so sketches meant to be merged
+// should be created with NewPlus. Clear sets it back to minP; maxP is not
+// preserved by GobEncode.
+func NewAdaptive(minP, maxP uint8, opts ...PlusOption) (*HyperLogLogPlus, error) {
+	if maxP < minP || maxP > 18 {
+		return nil, fmt.Errorf("%w: maximum must be between %d and 18", ErrInvalidPrecision, minP)
+	}
+	h, err := NewPlus(minP, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.maxP = maxP
+	return h, nil
+}
+
+// NewPlusDense returns a new initialized HyperLogLogPlus that starts out in the
+// normal representation, skipping the explicit and sparse ones. It suits
+// sketches known to grow large, which would otherwise soon pay for converting
+// to the normal representation. Clear sets it back to the explicit
+// representation like any other HyperLogLogPlus, while ClearReuse keeps it
+// normal.
+func NewPlusDense(precision uint8, opts ...PlusOption) (*HyperLogLogPlus, error) {
+	h, err := NewPlus(precision, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.ClearReuse()
+	return h, nil
+}
+
+// Clear sets HyperLogLogPlus h back to its initial state. The memory of the
+// pending hashes and the sparse list of a sparse h is kept for reuse, so that
+// pooled sketches that stay sparse are refilled without allocating them again.
 func (h *HyperLogLogPlus) Clear() {
+	if h.initP != 0 {
+		h.p = h.initP
+		h.m = 1 << h.initP
+	}
+	if h.initSparseP != 0 {
+		h.sparseP = h.initSparseP
+	}
 	h.sparse = true
-	h.tmpSet = set{}
-	h.sparseList = newCompressedList(int(h.m))
+	h.explicit = h.explicitLimit > 0
+	h.explicitSet = nil
+	if h.tmpSet != nil {
+		h.tmpSet.Clear()
+	} else {
+		h.tmpSet = set{}
+	}
+	if h.sparseList != nil {
+		h.sparseList.Reset()
+	} else {
+		h.sparseList = newCompressedList(sparseInitialCapacity)
+	}
 	h.reg = nil
+	h.blendOffset, h.blendBase = 0, 0
+	h.count.Store(0)
+}
+
+// ClearReuse sets HyperLogLogPlus h back to an empty state in the normal
+// representation. Unlike Clear, it zeroes the existing registers in place
+// rather than allocating a new sparse representation, which avoids garbage
+// when a pooled sketch is refilled with enough items to become normal anyway.
+func (h *HyperLogLogPlus) ClearReuse() {
+	if h.reg == nil {
+		h.reg = make([]uint8, h.m)
+	} else {
+		clear(h.reg)
+	}
+
+	h.sparse = false
+	h.explicit = false
+	h.explicitSet = nil
+	h.tmpSet = nil
+	h.sparseList = nil
+	h.blendOffset, h.blendBase = 0, 0
+	h.count.Store(0)
+}
+
+// Adds a hash to the explicit set of HyperLogLogPlus h. Converts to sparse if
+// the set grows too large.
+func (h *HyperLogLogPlus) addExplicit(x uint64) {
+	i, found := slices.BinarySearch(h.explicitSet, x)
+	if found {
+		return
+	}
+	h.explicitSet = slices.Insert(h.explicitSet, i, x)
+	h.promote()
 }
 
-// Converts HyperLogLogPlus h to the normal representation from the sparse
+// Converts HyperLogLogPlus h to the sparse representation from the explicit
 // representation.
+func (h *HyperLogLogPlus) toSparse() {
+	for _, x := range h.explicitSet {
+		h.tmpSet.Add(h.encodeHash(x))
+	}
+
+	h.explicit = false
+	h.explicitSet = nil
+	h.count.Store(0)
+	h.flushSparse()
+}
+
+// Converts HyperLogLogPlus h to the normal representation from the sparse or
+// explicit representation.
 func (h *HyperLogLogPlus) toNormal() {
 	h.reg = make([]uint8, h.m)
+	for _, x := range h.explicitSet {
+		h.addNormal(x)
+	}
 	for iter := h.sparseList.Iter(); iter.HasNext(); {
 		i, r := h.decodeHash(iter.Next())
 		if h.reg[i] < r {
@@ -139,41 +489,104 @@ func (h *HyperLogLogPlus) toNormal() {
 	}
 
 	h.sparse = false
+	h.explicit = false
+	h.explicitSet = nil
 	h.tmpSet = nil
 	h.sparseList = nil
+	h.blendOffset, h.blendBase = 0, 0
+	h.count.Store(0)
+}
+
+// Converts HyperLogLogPlus h to the normal representation like toNormal, and
+// keeps the difference between the estimates before and after for Count to
+// blend out.
+func (h *HyperLogLogPlus) toNormalBlended() {
+	sparse := float64(h.estimate())
+	h.toNormal()
+	h.blendBase = float64(h.estimateRegisters(h.reg))
+	h.blendOffset = sparse - h.blendBase
+}
+
+// Adds a hash to the registers of HyperLogLogPlus h in the normal
+// representation.
+func (h *HyperLogLogPlus) addNormal(x uint64) {
+	i, zeroBits := indexRank64(x, h.p, maxRank64(h.p))
+	if zeroBits > h.reg[i] {
+		h.reg[i] = zeroBits
+	}
+}
+
+// ToHLL64 converts HyperLogLogPlus h to the dense representation and returns a
+// HyperLogLog64 of the same precision holding a copy of its registers. Dense
+// registers of both types are computed the same way, so the result can be
+// merged with other HyperLogLog64 sketches. The compactness of the sparse
+// representation is lost.
+func (h *HyperLogLogPlus) ToHLL64() (*HyperLogLog64, error) {
+	if h.sparse {
+		h.mergeSparseAndToNormal()
+	}
+
+	h64, err := New64(h.p)
+	if err != nil {
+		return nil, err
+	}
+	copy(h64.reg, h.reg)
+	h64.registersChanged()
+	return h64, nil
 }
 
 // Add adds a new item to HyperLogLogPlus h.
 func (h *HyperLogLogPlus) Add(item Hash64) {
-	x := item.Sum64()
-	if h.sparse {
+	h.AddUint64(item.Sum64())
+}
+
+// AddUint64 adds a new hash to HyperLogLogPlus h.
+func (h *HyperLogLogPlus) AddUint64(x uint64) {
+	h.count.Store(0)
+	if h.explicit {
+		h.addExplicit(x)
+	} else if h.sparse {
 		h.tmpSet.Add(h.encodeHash(x))
-		h.maybeMerge()
+		h.promote()
 	} else {
-		i := eb64(x, 64, 64-h.p) // {x63,...,x64-p}
-		w := x<<h.p | 1<<(h.p-1) // {x63-p,...,x0}
-
-		zeroBits := clz64(w) + 1
-		if zeroBits > h.reg[i] {
-			h.reg[i] = zeroBits
-		}
+		h.addNormal(x)
 	}
 }
 
 // Merge takes another HyperLogLogPlus and combines it with HyperLogLogPlus h.
 func (h *HyperLogLogPlus) Merge(other *HyperLogLogPlus) error {
 	if h.p != other.p {
-		return errors.New("precisions must be equal")
+		return ErrPrecisionMismatch
+	}
+	if h.maxSparseBytes > 0 && !other.sparse {
+		return errSparseBudget
 	}
 
-	if h.sparse && other.sparse {
+	h.count.Store(0)
+	if other.explicit {
+		for _, x := range other.explicitSet {
+			h.AddUint64(x)
+		}
+		return nil
+	}
+
+	if h.explicit {
+		h.toSparse()
+	}
+
+	if h.sparse && other.sparse && (h.sparseP == other.sparseP || h.maxSparseBytes > 0) {
+		// A sketch with a sparse byte budget must stay sparse, so the
+		// keys of both are folded to the lower sparse precision.
+		if other.sparseP < h.sparseP {
+			h.foldSparse(other.sparseP)
+		}
 		for k := range other.tmpSet {
-			h.tmpSet.Add(k)
+			h.tmpSet.Add(foldHash(k, h.p, other.sparseP, h.sparseP))
 		}
 		for iter := other.sparseList.Iter(); iter.HasNext(); {
-			h.tmpSet.Add(iter.Next())
+			h.tmpSet.Add(foldHash(iter.Next(), h.p, other.sparseP, h.sparseP))
 		}
-		h.maybeMerge()
+		h.promote()
 		return nil
 	}
 
@@ -181,6 +594,7 @@ func (h *HyperLogLogPlus) Merge(other *HyperLogLogPlus) error {
 		h.mergeSparseAndToNormal()
 	}
 
+	h.blendOffset, h.blendBase = 0, 0
 	if other.sparse {
 		for k := range other.tmpSet {
 			i, r := other.decodeHash(k)
@@ -205,11 +619,381 @@ func (h *HyperLogLogPlus) Merge(other *HyperLogLogPlus) error {
 	return nil
 }
 
-// Merges tmpSet if it exceeds the threshold
-func (h *HyperLogLogPlus) maybeMerge() {
-	if uint32(len(h.tmpSet))*100 > h.m {
+// SparseHeadroom reports how close HyperLogLogPlus h is to being converted to
+// the normal representation, which happens once the sparse list takes more
+// than limit bytes. With WithMaxSparseBytes, limit is the budget, beyond which
+// the list is folded or its precision lowered instead. With the default normal
+// threshold and sparse precision, h may be converted a little earlier, once
+// its list holds more keys than OptimalSparseCutoff. used is the size of
+// the sparse list plus one byte for each hash not yet merged into it, the
+// least it takes once merged. Once h is normal, used equals limit.
+func (h *HyperLogLogPlus) SparseHeadroom() (used, limit int) {
+	limit = h.sparseLimit()
+	if !h.sparse {
+		return limit, limit
+	}
+	return h.sparseList.Len() + len(h.tmpSet) + len(h.explicitSet), limit
+}
+
+// Reprecision raises the precision of a sparse HyperLogLogPlus h to newP, as
+// if its hashes had been added at newP, so that a coarse sketch can be
+// refined without re-ingesting its items. newP must be lower than the sparse
+// precision. It fails once h is normal, since the registers no longer hold
+// enough of each hash.
+//
+// While h is explicit its raw hashes are kept and the result is exact. The
+// sparse representation keeps the first sp bits of each hash, where sp is the
+// sparse precision, and the rank of the rest only when the bits after the old
+// precision are all zero, so a hash whose bits after the old precision are
+// zero only up to newP gets the lowest rank consistent with the stored bits.
+// This affects a fraction 2^(newP-sp) of the hashes and biases the count
+// slightly low.
+func (h *HyperLogLogPlus) Reprecision(newP uint8) error {
+	if maxP := min(18, h.sparseP-1); newP < h.p || newP > maxP {
+		return fmt.Errorf("%w: must be between %d and %d", ErrInvalidPrecision, h.p, maxP)
+	}
+	if !h.sparse {
+		return errors.New("only sparse sketches can be reprecisioned")
+	}
+
+	h.reencode(newP)
+	if !h.explicit {
 		h.mergeSparse()
 	}
+	return nil
+}
+
+// Raises the precision of a sparse HyperLogLogPlus h to newP, leaving the
+// re-encoded keys pending.
+func (h *HyperLogLogPlus) reencode(newP uint8) {
+	keys := set{}
+	for k := range h.tmpSet {
+		keys.Add(reencodeHash(k, newP, h.sparseP))
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		keys.Add(reencodeHash(iter.Next(), newP, h.sparseP))
+	}
+
+	h.p = newP
+	h.m = 1 << newP
+	h.tmpSet = keys
+	h.sparseList = newCompressedList(sparseInitialCapacity)
+	h.count.Store(0)
+}
+
+// Re-encodes key k of the sparse representation of precision sp for precision
+// p, which must not be lower than the precision k was encoded for. Keys that
+// carry their rank do not depend on the precision. Other keys need one if the
+// index bits after p are all zero, but the hash bits that determine it were
+// dropped, so the lowest possible rank is used.
+func reencodeHash(k uint32, p, sp uint8) uint32 {
+	if k&1 == 1 {
+		return k
+	}
+	idx := k >> 1
+	if idx&(1<<(sp-p)-1) == 0 {
+		return idx<<7 | 1<<1 | 1
+	}
+	return k
+}
+
+// SparseFold lowers the sparse precision of a sparse HyperLogLogPlus h to
+// newSP, as if its hashes had been added with WithSparsePrecision(newSP), so
+// that sketches can be stored with fewer distinct sparse keys at the cost of
+// sparse accuracy. newSP must be greater than the precision of h and at most
+// its current sparse precision. The keys hold every hash bit the coarser
+// encoding needs, so the result is exact. It fails once h is normal.
+func (h *HyperLogLogPlus) SparseFold(newSP uint8) error {
+	if newSP <= h.p || newSP > h.sparseP {
+		return fmt.Errorf("%w: sparse precision must be between %d and %d", ErrInvalidPrecision, h.p+1, h.sparseP)
+	}
+	if !h.sparse {
+		return errors.New("only sparse sketches can be sparse folded")
+	}
+	h.foldSparse(newSP)
+	h.promote()
+	return nil
+}
+
+// Lowers the sparse precision of sparse HyperLogLogPlus h to newSP without
+// otherwise changing its representation.
+func (h *HyperLogLogPlus) foldSparse(newSP uint8) {
+	keys := set{}
+	for k := range h.tmpSet {
+		keys.Add(foldHash(k, h.p, h.sparseP, newSP))
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		keys.Add(foldHash(iter.Next(), h.p, h.sparseP, newSP))
+	}
+
+	h.sparseP = newSP
+	h.tmpSet = keys
+	h.sparseList = newCompressedList(sparseInitialCapacity)
+	h.count.Store(0)
+	if !h.explicit {
+		h.flushSparse()
+	}
+}
+
+// errSparseBudget is returned when normal registers are merged into a
+// HyperLogLogPlus created with WithMaxSparseBytes, which cannot hold them.
+var errSparseBudget = errors.New("normal registers cannot be merged into a sketch with a sparse byte budget")
+
+// minPlusPrecision is the lowest precision of a HyperLogLogPlus, to which
+// WithMaxSparseBytes lowers it at most.
+const minPlusPrecision = 4
+
+// minSparseBytes is the smallest budget accepted by WithMaxSparseBytes: the
+// largest sparse list of precision 4 and sparse precision 5, with one key for
+// each of its 32 sparse registers taking at most 2 bytes.
+const minSparseBytes = 64
+
+// Rebuilds the sparse list of sparse HyperLogLogPlus h, merging pending
+// hashes into it, at precision newP, which is either that of h or one lower,
+// keeping its sparse precision. Lowering the precision keeps a key carrying
+// its rank one if the index bit at the old precision is zero, its rank then
+// counting that bit as well, but makes it need none if the bit is one. Keys
+// carrying their rank for the same sparse register are then reduced to the
+// one of the highest rank, so that the list holds at most one key for each
+// sparse register.
+func (h *HyperLogLogPlus) rebuildSparse(newP uint8) {
+	bit := uint32(0)
+	if newP < h.p {
+		bit = 1 << (h.sparseP - h.p)
+	}
+	keys := make(sortableSlice, 0, int(h.sparseList.Count)+len(h.tmpSet))
+	for k := range h.tmpSet {
+		keys = append(keys, shrinkHash(k, bit))
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		keys = append(keys, shrinkHash(iter.Next(), bit))
+	}
+	sort.Sort(keys)
+
+	h.p = newP
+	h.m = 1 << newP
+	h.tmpSet.Clear()
+	h.sparseList = newCompressedList(sparseInitialCapacity)
+	for i, k := range keys {
+		// Keys of the same sparse register sort by rank, so only the last
+		// of each run is kept.
+		if i+1 < len(keys) {
+			if next := keys[i+1]; next == k || k&next&1 == 1 && k>>7 == next>>7 {
+				continue
+			}
+		}
+		h.sparseList.Append(k)
+	}
+	h.count.Store(0)
+}
+
+// Re-encodes key k of the sparse representation for a precision one lower,
+// where bit is the index bit at the old precision, or 0 to keep the
+// precision.
+func shrinkHash(k, bit uint32) uint32 {
+	if k&1 == 1 && (k>>7)&bit != 0 {
+		return k >> 7 << 1
+	}
+	return k
+}
+
+// Re-encodes key k of the sparse representation of precision p and sparse
+// precision sp for the lower sparse precision newSP. The w = sp-newSP index
+// bits dropped from k come right after the new index, so they either add w to
+// the zeros a key carrying its rank already counts past them, or, if they
+// hold a one, give the rank of a key that now needs one.
+func foldHash(k uint32, p, sp, newSP uint8) uint32 {
+	w := sp - newSP
+	if k&1 == 1 {
+		idx, zeros := k>>7, eb32(k, 7, 1)
+		return idx>>w<<7 | (zeros+uint32(w))<<1 | 1
+	}
+
+	idx := k >> 1
+	newIdx, dropped := idx>>w, idx&(1<<w-1)
+	if eb32(newIdx, newSP-p, 0) != 0 {
+		return newIdx << 1
+	}
+	zeros := clz32(dropped<<(32-w)) + 1
+	return newIdx<<7 | uint32(zeros)<<1 | 1
+}
+
+// OptimalSparseCutoff returns the number of distinct items beyond which the
+// sparse list of a HyperLogLogPlus of precision p, with the default sparse
+// precision, takes more than the m bytes of the normal registers. It is
+// measured by encoding the sparse keys of a deterministic stream of hashes,
+// so it is what the representations cost in practice rather than a bound.
+// A HyperLogLogPlus with the default normal threshold and sparse precision
+// becomes normal once its sparse list holds more keys than the cutoff, or
+// takes more than m bytes if that comes first. The cutoff also helps choose
+// between NewPlus and NewPlusDense. It returns 0 for an invalid precision.
+func OptimalSparseCutoff(p uint8) int {
+	h, err := NewPlus(p, WithExplicitThreshold(0))
+	if err != nil {
+		return 0
+	}
+
+	// Each hash adds at most one key, so fewer than 2m hashes give a list of
+	// more than m bytes; find the shortest prefix of hashes that does.
+	keys := make([]uint32, 2*h.m)
+	for i := range keys {
+		keys[i] = h.encodeHash(fmix64(uint64(i) + 1))
+	}
+	n := sort.Search(len(keys), func(n int) bool {
+		return sparseListBytes(keys[:n+1]) > int(h.m)
+	})
+	return n
+}
+
+// sparseCutoffs holds OptimalSparseCutoff(p) plus one at index p once it has
+// been computed, and 0 before.
+var sparseCutoffs [19]atomic.Int32
+
+// Reports whether the sparse list of HyperLogLogPlus h holds more keys than
+// OptimalSparseCutoff, which is computed once for each precision. It only
+// applies with the default normal threshold and sparse precision, for which
+// the cutoff is measured.
+func (h *HyperLogLogPlus) pastSparseCutoff() bool {
+	if h.normalThreshold > 0 || h.sparseP != pPrime {
+		return false
+	}
+	c := int(sparseCutoffs[h.p].Load()) - 1
+	if c < 0 {
+		c = OptimalSparseCutoff(h.p)
+		sparseCutoffs[h.p].Store(int32(c + 1))
+	}
+	return int(h.sparseList.Count) > c
+}
+
+// Returns the encoded length of the sparse list holding keys.
+func sparseListBytes(keys []uint32) int {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	l := newCompressedList(0)
+	for _, k := range slices.Compact(sorted) {
+		l.Append(k)
+	}
+	return l.Len()
+}
+
+// SparseBytes returns the encoded length of the sparse list of HyperLogLogPlus
+// h, which is converted to the normal representation once it exceeds m bytes.
+// Hashes not yet merged into the list are not included; Compact merges them.
+// It is 0 when h is explicit or normal.
+func (h *HyperLogLogPlus) SparseBytes() int {
+	if !h.sparse {
+		return 0
+	}
+	return h.sparseList.Len()
+}
+
+// SizeBytes returns the approximate memory used by HyperLogLogPlus h: the size
+// of its registers when normal, and otherwise the size of the sparse list plus
+// that of the explicit and pending hashes. It ignores the overhead of maps and
+// slice headers.
+func (h *HyperLogLogPlus) SizeBytes() int {
+	if !h.sparse {
+		return len(h.reg)
+	}
+	return h.sparseList.Len() + 4*len(h.tmpSet) + 8*len(h.explicitSet)
+}
+
+// MergeInto combines HyperLogLogPlus h into dst, leaving h unchanged. It is
+// equivalent to dst.Merge(h) and lets a reduction keep a normal sketch as the
+// accumulator: a small sparse h is merged by decoding its hashes directly into
+// the registers of dst.
+func (h *HyperLogLogPlus) MergeInto(dst *HyperLogLogPlus) error {
+	return dst.Merge(h)
+}
+
+// Mode returns the representation HyperLogLogPlus h is currently in: "exact"
+// while it stores its hashes explicitly, then "sparse" or "dense".
+func (h *HyperLogLogPlus) Mode() string {
+	switch {
+	case h.explicit:
+		return "exact"
+	case h.sparse:
+		return "sparse"
+	default:
+		return "dense"
+	}
+}
+
+// ForEachSparse calls f with the index and rank of each nonzero register of
+// HyperLogLogPlus h, in ascending index order. When h is sparse the registers
+// are decoded from the sparse representation, merging pending hashes into the
+// sparse list first, without converting h to the normal representation even
+// if the merged list outgrows it; the next Add converts it then.
+func (h *HyperLogLogPlus) ForEachSparse(f func(index uint32, rank uint8)) {
+	if h.sparse && !h.explicit {
+		h.flushSparse()
+	}
+	if !h.sparse {
+		for i, r := range h.reg {
+			if r != 0 {
+				f(uint32(i), r)
+			}
+		}
+		return
+	}
+
+	ranks := map[uint32]uint8{}
+	for _, x := range h.explicitSet {
+		i, r := indexRank64(x, h.p, maxRank64(h.p))
+		if r > ranks[uint32(i)] {
+			ranks[uint32(i)] = r
+		}
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		if i, r := h.decodeHash(iter.Next()); r > ranks[i] {
+			ranks[i] = r
+		}
+	}
+
+	indexes := make([]uint32, 0, len(ranks))
+	for i := range ranks {
+		indexes = append(indexes, i)
+	}
+	slices.Sort(indexes)
+	for _, i := range indexes {
+		f(i, ranks[i])
+	}
+}
+
+// Compact merges the pending hashes of a sparse HyperLogLogPlus h into its
+// sparse list and trims the list and the explicit set to their used length,
+// reducing the memory retained by idle sketches. h remains usable afterwards.
+func (h *HyperLogLogPlus) Compact() {
+	if !h.sparse {
+		return
+	}
+
+	if h.explicit {
+		h.explicitSet = append(make([]uint64, 0, len(h.explicitSet)), h.explicitSet...)
+	} else if len(h.tmpSet) > 0 {
+		h.mergeSparse()
+		if !h.sparse {
+			return
+		}
+	}
+
+	// Maps never shrink, so drop the map holding any former transient hashes.
+	h.tmpSet = set{}
+	h.sparseList.b = append(make(variableLengthList, 0, len(h.sparseList.b)), h.sparseList.b...)
+}
+
+// Returns the number of hashes in tmpSet that are not in the sparse list.
+func (h *HyperLogLogPlus) pendingSparse() uint32 {
+	n := uint32(len(h.tmpSet))
+	if n == 0 {
+		return 0
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		if h.tmpSet[iter.Next()] {
+			n--
+		}
+	}
+	return n
 }
 
 // Estimates the bias using empirically determined values.
@@ -236,23 +1020,71 @@ func (h *HyperLogLogPlus) estimateBias(est float64) float64 {
 	return b1*(1-c) + b2*c
 }
 
-// Count returns the cardinality estimate.
+// Count returns the cardinality estimate. The result is cached, so calling
+// Count again without modifying h in between is cheap. Count does not change
+// the representation of h: hashes pending in the sparse representation are
+// counted with the sparse list rather than merged into it. It is therefore
+// safe to call from several goroutines as long as none of them modifies h.
 func (h *HyperLogLogPlus) Count() uint64 {
-	if h.sparse {
-		h.mergeSparse()
+	if c := h.count.Load(); c != 0 {
+		return c - 1
+	}
+	n := h.estimate()
+	h.count.Store(n + 1)
+	return n
+}
+
+// Computes the cardinality estimate.
+func (h *HyperLogLogPlus) estimate() uint64 {
+	if h.explicit {
+		return uint64(len(h.explicitSet))
 	}
 
 	if h.sparse {
-		return uint64(linearCounting(mPrime, mPrime-uint32(h.sparseList.Count)))
+		n := uint64(h.sparseList.Count) + uint64(h.pendingSparse())
+		mPrime := uint64(1) << h.sparseP
+		if n < mPrime {
+			return uint64(linearCounting(mPrime, mPrime-n))
+		}
+		// Every sparse register is set, which leaves linear counting
+		// nothing to count, so estimate from the normal registers instead.
+		return h.estimateRegisters(h.sparseRegisters())
 	}
+	return h.blend(h.estimateRegisters(h.reg))
+}
 
-	est := calculateEstimate(h.reg)
+// Corrects normal estimate est of HyperLogLogPlus h by the difference between
+// the sparse and normal estimates at its conversion to the normal
+// representation. The sparse estimate is the more accurate one, so without
+// the correction the count jumps by the error of the normal registers when h
+// is converted. The correction fades out linearly as est grows past the
+// normal estimate at the conversion, over a span of that estimate or of the
+// correction itself if it is larger, so that the correction never shrinks
+// faster than est grows and the blended count never drops as est rises. It is
+// not preserved by GobEncode or kept across a Merge.
+func (h *HyperLogLogPlus) blend(est uint64) uint64 {
+	if h.blendBase == 0 {
+		return est
+	}
+	span := max(h.blendBase, h.blendOffset)
+	w := min(max(1-(float64(est)-h.blendBase)/span, 0), 1)
+	return uint64(max(float64(est)+w*h.blendOffset, 0))
+}
+
+// Computes the cardinality estimate from the normal registers reg.
+func (h *HyperLogLogPlus) estimateRegisters(reg []uint8) uint64 {
+	var est float64
+	if h.compensated {
+		est = estimateFromSum(h.m, compensatedRegisterSum(reg))
+	} else {
+		est = calculateEstimate(reg)
+	}
 	if est <= float64(h.m)*5.0 {
 		est -= h.estimateBias(est)
 	}
 
-	if v := countZeros(h.reg); v != 0 {
-		lc := linearCounting(h.m, v)
+	if v := countZeros(reg); v != 0 {
+		lc := linearCounting(uint64(h.m), uint64(v))
 		if lc <= float64(threshold[h.p-4]) {
 			return uint64(lc)
 		}
@@ -260,6 +1092,24 @@ func (h *HyperLogLogPlus) Count() uint64 {
 	return uint64(est)
 }
 
+// Returns the normal registers of sparse HyperLogLogPlus h, including the
+// pending hashes, without converting h to the normal representation.
+func (h *HyperLogLogPlus) sparseRegisters() []uint8 {
+	reg := make([]uint8, h.m)
+	add := func(k uint32) {
+		if i, r := h.decodeHash(k); r > reg[i] {
+			reg[i] = r
+		}
+	}
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		add(iter.Next())
+	}
+	for k := range h.tmpSet {
+		add(k)
+	}
+	return reg
+}
+
 // Encode HyperLogLogPlus into a gob
 func (h *HyperLogLogPlus) GobEncode() ([]byte, error) {
 	buf := bytes.Buffer{}
@@ -290,12 +1140,28 @@ func (h *HyperLogLogPlus) GobEncode() ([]byte, error) {
 			return nil, err
 		}
 	}
+	if err := enc.Encode(h.explicit); err != nil {
+		return nil, err
+	}
+	if h.explicit {
+		if err := enc.Encode(h.explicitSet); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Encode(h.sparseP); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
 // Decode gob into a HyperLogLogPlus structure
 func (h *HyperLogLogPlus) GobDecode(b []byte) error {
 	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	h.count.Store(0)
+	h.blendOffset, h.blendBase = 0, 0
+	// The precisions h was created with are not encoded, so Clear restores
+	// the decoded ones.
+	defer func() { h.initP, h.initSparseP = h.p, h.sparseP }()
 	if err := dec.Decode(&h.reg); err != nil {
 		return err
 	}
@@ -308,11 +1174,14 @@ func (h *HyperLogLogPlus) GobDecode(b []byte) error {
 	if err := dec.Decode(&h.sparse); err != nil {
 		return err
 	}
+	if err := checkDecoded(h.p, 18, h.m, h.reg, !h.sparse); err != nil {
+		return err
+	}
 	if h.sparse {
 		if err := dec.Decode(&h.tmpSet); err != nil {
 			return err
 		}
-		h.sparseList = newCompressedList(int(h.m))
+		h.sparseList = newCompressedList(0)
 		if err := dec.Decode(&h.sparseList.Count); err != nil {
 			return err
 		}
@@ -323,5 +1192,32 @@ func (h *HyperLogLogPlus) GobDecode(b []byte) error {
 			return err
 		}
 	}
+	// Gobs written before the explicit representation existed end here.
+	h.explicit, h.explicitSet = false, nil
+	h.sparseP = pPrime
+	if err := dec.Decode(&h.explicit); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if h.explicit {
+		if err := dec.Decode(&h.explicitSet); err != nil {
+			return err
+		}
+		if h.explicitLimit == 0 {
+			h.explicitLimit = explicitThreshold
+		}
+	}
+
+	// Gobs written before the sparse precision was configurable end here.
+	if err := dec.Decode(&h.sparseP); err == io.EOF {
+		h.sparseP = pPrime
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if h.sparseP <= h.p || h.sparseP > pPrime {
+		return fmt.Errorf("%w: sparse precision %d out of range", ErrInvalidEncoding, h.sparseP)
+	}
 	return nil
 }
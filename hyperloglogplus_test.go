@@ -3,8 +3,14 @@ package hyperloglog
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"maps"
 	"math"
+	"math/rand"
 	"reflect"
+	"slices"
+	"sync"
 	"testing"
 )
 
@@ -12,6 +18,14 @@ type fakeHash64 uint64
 
 func (f fakeHash64) Sum64() uint64 { return uint64(f) }
 
+// newPlusSparse returns a HyperLogLogPlus that skips the explicit
+// representation, for tests of the sparse one.
+func newPlusSparse(precision uint8) *HyperLogLogPlus {
+	h, _ := NewPlus(precision)
+	h.toSparse()
+	return h
+}
+
 func abs(x int64) int64 {
 	if x < 0 {
 		return -x
@@ -362,7 +376,7 @@ func TestHLLPPClear(t *testing.T) {
 }
 
 func TestHLLPPMerge(t *testing.T) {
-	h, _ := NewPlus(16)
+	h := newPlusSparse(16)
 
 	k1 := uint64(0xf000017000000000)
 	h.Add(fakeHash64(k1))
@@ -497,6 +511,109 @@ func TestHLLPPEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestHLLPPSparsePrecision(t *testing.T) {
+	for _, sp := range []uint8{15, 20, 25} {
+		h, err := NewPlus(14, WithSparsePrecision(sp), WithExplicitThreshold(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			x := r.Uint64()
+			wantI, wantR := indexRank64(x, 14, maxRank64(14))
+			if i, r := h.decodeHash(h.encodeHash(x)); uint64(i) != wantI || r != wantR {
+				t.Errorf("sp=%d x=%#x: got (%d, %d), want (%d, %d)", sp, x, i, r, wantI, wantR)
+			}
+		}
+		// Hashes whose rank is stored in the key.
+		for _, x := range []uint64{0xfffc000000000000, 0xfffc000000000001, 0xfffc100000000000} {
+			wantI, wantR := indexRank64(x, 14, maxRank64(14))
+			if i, r := h.decodeHash(h.encodeHash(x)); uint64(i) != wantI || r != wantR {
+				t.Errorf("sp=%d x=%#x: got (%d, %d), want (%d, %d)", sp, x, i, r, wantI, wantR)
+			}
+		}
+
+		for i := 0; i < 2000; i++ {
+			h.AddUint64(r.Uint64())
+		}
+		if !h.sparse {
+			t.Fatalf("sp=%d: h should still be sparse", sp)
+		}
+		if n := h.Count(); math.Abs(float64(n)-2000) > 40 {
+			t.Errorf("sp=%d: count %d", sp, n)
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(h); err != nil {
+			t.Fatal(err)
+		}
+		var h2 HyperLogLogPlus
+		if err := gob.NewDecoder(&buf).Decode(&h2); err != nil {
+			t.Fatal(err)
+		}
+		if h2.sparseP != sp || h2.Count() != h.Count() {
+			t.Errorf("sp=%d: decoded sparse precision %d, count %d", sp, h2.sparseP, h2.Count())
+		}
+	}
+
+	for _, sp := range []uint8{14, 26} {
+		if _, err := NewPlus(14, WithSparsePrecision(sp)); !errors.Is(err, ErrInvalidPrecision) {
+			t.Error(sp, err)
+		}
+	}
+}
+
+func TestHLLPPSparseCountFull(t *testing.T) {
+	h, _ := NewPlus(4, WithExplicitThreshold(0), WithSparsePrecision(5))
+	if !h.sparse || h.explicit {
+		t.Fatal(h.Mode())
+	}
+
+	// Fill all but one of the 32 sparse registers, each with a rank of 2,
+	// without merging them into the sparse list.
+	for i := uint32(0); i < 31; i++ {
+		h.tmpSet.Add(i<<7 | 1<<1 | 1)
+	}
+	if n, want := h.estimate(), uint64(linearCounting(32, 1)); n != want {
+		t.Error(n, want)
+	}
+
+	// With every sparse register set, linear counting gives no estimate, so
+	// the normal estimate over the 16 registers is used.
+	h.tmpSet.Add(31<<7 | 1<<1 | 1)
+	reg := make([]uint8, 16)
+	for i := range reg {
+		reg[i] = 2
+	}
+	if n, want := h.estimate(), h.estimateRegisters(reg); n != want || n > 1000 {
+		t.Error(n, want)
+	}
+}
+
+func TestHLLPPMergeSparsePrecision(t *testing.T) {
+	a, _ := NewPlus(12, WithSparsePrecision(20), WithExplicitThreshold(0))
+	b, _ := NewPlus(12, WithExplicitThreshold(0))
+	want, _ := New64(12)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		x := r.Uint64()
+		if i%2 == 0 {
+			a.AddUint64(x)
+		} else {
+			b.AddUint64(x)
+		}
+		want.AddUint64(x)
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(a.DenseRegisters(), want.reg) {
+		t.Error("registers differ")
+	}
+}
+
 func TestHLLPPError(t *testing.T) {
 	_, err := NewPlus(3)
 	if err == nil {
@@ -558,9 +675,10 @@ func TestHLLPPEstimateBiasCount(t *testing.T) {
 }
 
 func TestHLLPPToNormalWhenSparseIsTooBig(t *testing.T) {
-	h, _ := NewPlus(4)
+	h := newPlusSparse(4)
+	cutoff := OptimalSparseCutoff(4)
 
-	for i := 0; i < 16; i++ {
+	for i := 0; i < cutoff; i++ {
 		h.Add(fakeHash64(1 << uint(i)))
 	}
 
@@ -568,16 +686,16 @@ func TestHLLPPToNormalWhenSparseIsTooBig(t *testing.T) {
 		t.Error("h should still be sparse")
 	}
 
-	h.Add(fakeHash64(1 << 16))
+	h.Add(fakeHash64(1 << uint(cutoff)))
 	if h.sparse {
 		t.Error("h should be converted to normal")
 	}
 }
 
 func TestHLLPPToNormalWhenCountIsCalledOften(t *testing.T) {
-	h, _ := NewPlus(7)
+	h := newPlusSparse(7)
 
-	for i := 0; i < 128; i++ {
+	for i := 0; i < OptimalSparseCutoff(7); i++ {
 		h.Add(fakeHash64(i << 39))
 		h.Count()
 	}
@@ -588,9 +706,1157 @@ func TestHLLPPToNormalWhenCountIsCalledOften(t *testing.T) {
 		t.Error("h should still be sparse")
 	}
 
+	// Count does not change the representation; the next merge of pending
+	// hashes does.
 	h.Count()
+	if !h.sparse {
+		t.Error("Count should not convert h to normal")
+	}
+
+	h.Add(fakeHash64(2))
+	if h.sparse {
+		t.Error("h should be converted to normal")
+	}
+}
+
+func TestHLLPPCountCached(t *testing.T) {
+	h := newPlusSparse(16)
+	h.Add(fakeHash64(0x00010fffffffffff))
+	h.Add(fakeHash64(0x00020fffffffffff))
+
+	n := h.Count()
+	if n != 2 {
+		t.Error(n)
+	}
+
+	// A second Count must not recompute the estimate, so a key slipped into
+	// tmpSet behind the sketch's back is not picked up.
+	h.tmpSet.Add(h.encodeHash(0x00030fffffffffff))
+	n = h.Count()
+	if n != 2 {
+		t.Error(n)
+	}
+
+	h.Add(fakeHash64(0x00040fffffffffff))
+	n = h.Count()
+	if n != 4 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPCountDoesNotMerge(t *testing.T) {
+	h := newPlusSparse(16)
+	for i := uint64(1); i <= 200; i++ {
+		h.Add(fakeHash64(i << 44))
+		if i%50 == 0 {
+			tmp := maps.Clone(h.tmpSet)
+			listLen := h.sparseList.Len()
+			if n := h.Count(); n != i {
+				t.Error(i, n)
+			}
+			if !maps.Equal(tmp, h.tmpSet) || h.sparseList.Len() != listLen {
+				t.Error(i, "Count should not modify the sparse representation")
+			}
+		}
+	}
+}
+
+// Run with -race to check that concurrent Counts do not race.
+func TestHLLPPCountConcurrent(t *testing.T) {
+	h := newPlusSparse(14)
+	for i := uint64(0); i < 2000; i++ {
+		h.AddUint64(fmix64(i))
+	}
+	if len(h.tmpSet) == 0 {
+		t.Fatal("h should have pending hashes")
+	}
+
+	counts := make([]uint64, 4)
+	var wg sync.WaitGroup
+	for g := range counts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				counts[g] = h.Count()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, n := range counts {
+		if n != counts[0] || math.Abs(float64(n)-2000) > 20 {
+			t.Error(counts)
+		}
+	}
+}
+
+func TestHLLPPToHLL64(t *testing.T) {
+	h, _ := NewPlus(14)
+	h64, _ := New64(14)
+	for i := uint64(0); i < 50000; i++ {
+		x := i * 0x9e3779b97f4a7c15
+		h.Add(fakeHash64(x))
+		h64.AddUint64(x)
+	}
+
+	c, err := h.ToHLL64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.sparse {
+		t.Error("ToHLL64 should convert to normal")
+	}
+	if n := c.Count(); n != h.Count() {
+		t.Error(n, h.Count())
+	}
+	if !reflect.DeepEqual(c.reg, h64.reg) {
+		t.Error("registers differ from HyperLogLog64 with the same input")
+	}
+
+	if err := h64.Merge(c); err != nil {
+		t.Error(err)
+	}
+	if n := h64.Count(); n != c.Count() {
+		t.Error(n)
+	}
+}
+
+func BenchmarkHLLPPAdd(b *testing.B) {
+	xs := make([]uint64, 1e6)
+	for i := range xs {
+		xs[i] = uint64(i) * 0x9e3779b97f4a7c15
+	}
+
+	b.Run("Add", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h, _ := NewPlus(14)
+			for _, x := range xs {
+				h.Add(fakeHash64(x))
+			}
+		}
+	})
+	b.Run("AddUint64", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h, _ := NewPlus(14)
+			for _, x := range xs {
+				h.AddUint64(x)
+			}
+		}
+	})
+}
+
+func TestHLLPPMergeSparseAppend(t *testing.T) {
+	h := newPlusSparse(16)
+
+	keys := []uint64{0x0001000000000000, 0x000100f000000000, 0x0fff00f000000000}
+	for _, k := range keys[:2] {
+		h.Add(fakeHash64(k))
+	}
+	h.mergeSparse()
+	l := h.sparseList
+
+	// Keys after the tail of the list are appended in place.
+	h.Add(fakeHash64(keys[2]))
+	h.mergeSparse()
+	if h.sparseList != l {
+		t.Error("sparse list should be appended to")
+	}
+
+	// Keys before the tail require a rebuild.
+	h.Add(fakeHash64(0x0000ff0000000000))
+	h.mergeSparse()
+	if h.sparseList == l {
+		t.Error("sparse list should be rebuilt")
+	}
+
+	var prev uint32
+	for iter := h.sparseList.Iter(); iter.HasNext(); {
+		n := iter.Next()
+		if n <= prev {
+			t.Error("sparse list is not sorted", n, prev)
+		}
+		prev = n
+	}
+	if h.sparseList.Count != 4 {
+		t.Error(h.sparseList.Count)
+	}
+}
+
+func BenchmarkHLLPPMergeSparseMonotonic(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		h, _ := NewPlus(18)
+		for j := uint64(0); j < 1e5; j++ {
+			h.AddUint64(j<<40 | 1<<39)
+		}
+		if !h.sparse {
+			b.Fatal("h should still be sparse")
+		}
+	}
+}
+
+func TestHLLPPExplicit(t *testing.T) {
+	h, _ := NewPlus(10)
+	for i := uint64(1); i <= explicitThreshold; i++ {
+		h.AddUint64(i * 0x9e3779b97f4a7c15)
+		h.AddUint64(i * 0x9e3779b97f4a7c15)
+		if n := h.Count(); n != i {
+			t.Error(i, n)
+		}
+	}
+	if !h.explicit {
+		t.Error("h should still be explicit")
+	}
+
+	x := uint64(explicitThreshold + 1)
+	h.AddUint64(x * 0x9e3779b97f4a7c15)
+	if h.explicit || !h.sparse {
+		t.Error("h should be converted to sparse")
+	}
+	if n := h.Count(); n != explicitThreshold+1 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPWithExplicitThreshold(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	h, _ := NewPlus(14, WithExplicitThreshold(256))
+	for i := uint64(1); i <= 256; i++ {
+		h.AddUint64(r.Uint64())
+		if n := h.Count(); n != i {
+			t.Error(i, n)
+		}
+	}
+	if !h.explicit {
+		t.Error("h should still be explicit")
+	}
+
+	for i := 257; i <= 300; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	if h.explicit || !h.sparse {
+		t.Error("h should be converted to sparse")
+	}
+	if n := h.Count(); n < 299 || n > 301 {
+		t.Error(n)
+	}
+
+	h.Clear()
+	if !h.explicit {
+		t.Error("Clear should keep the explicit threshold")
+	}
+
+	h, _ = NewPlus(14, WithExplicitThreshold(0))
+	if h.explicit || !h.sparse {
+		t.Error("h should start out sparse")
+	}
+	h.AddUint64(r.Uint64())
+	if n := h.Count(); n != 1 {
+		t.Error(n)
+	}
+}
 
+func TestHLLPPExplicitToNormal(t *testing.T) {
+	h, _ := NewPlus(10)
+	r := rand.New(rand.NewSource(1))
+	var last uint64
+	for i := uint64(1); i <= 5000; i++ {
+		h.AddUint64(r.Uint64())
+
+		n := h.Count()
+		if n+5 < last {
+			t.Error("count dropped", i, last, n)
+		}
+		last = n
+
+		maxErr := 0.02
+		if !h.sparse {
+			maxErr = 0.1
+		}
+		if e := math.Abs(float64(n)-float64(i)) / float64(i); e > maxErr {
+			t.Error(i, n, e)
+		}
+	}
 	if h.sparse {
 		t.Error("h should be converted to normal")
 	}
 }
+
+func TestHLLPPMergeExplicit(t *testing.T) {
+	h, _ := NewPlus(16)
+	h2, _ := NewPlus(16)
+	for i := uint64(1); i <= 10; i++ {
+		h.AddUint64(i * 0x9e3779b97f4a7c15)
+		h2.AddUint64((i + 5) * 0x9e3779b97f4a7c15)
+	}
+
+	if err := h.Merge(h2); err != nil {
+		t.Error(err)
+	}
+	if !h.explicit {
+		t.Error("h should still be explicit")
+	}
+	if n := h.Count(); n != 15 {
+		t.Error(n)
+	}
+
+	h3 := newPlusSparse(16)
+	h3.Merge(h)
+	if n := h3.Count(); n != 15 {
+		t.Error(n)
+	}
+
+	h4, _ := NewPlus(16)
+	h4.toNormal()
+	h4.Merge(h)
+	if n := h4.Count(); n != 15 {
+		t.Error(n)
+	}
+
+	// Merging a sparse sketch into an explicit one converts it to sparse.
+	h.Merge(h3)
+	if h.explicit || !h.sparse {
+		t.Error("h should be converted to sparse")
+	}
+	if n := h.Count(); n != 15 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPGobCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	enc.Encode([]uint8{})
+	enc.Encode(uint32(1 << 14))
+	enc.Encode(uint8(14))
+	enc.Encode(false)
+
+	var h HyperLogLogPlus
+	if err := h.GobDecode(buf.Bytes()); err == nil || err.Error() != "invalid encoding: 0 registers for precision 14" {
+		t.Error(err)
+	}
+}
+
+func TestHLLPPGobBeforeExplicit(t *testing.T) {
+	h := newPlusSparse(8)
+	for _, x := range []uint64{0x00010fffffffffff, 0x00020fffffffffff, 0x00030fffffffffff} {
+		h.AddUint64(x)
+	}
+	h.mergeSparse()
+
+	// Encode h the way GobEncode did before the explicit representation.
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, v := range []interface{}{h.reg, h.m, h.p, h.sparse, h.tmpSet,
+		h.sparseList.Count, h.sparseList.b, h.sparseList.last} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var h2 HyperLogLogPlus
+	if err := h2.GobDecode(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if h2.explicit {
+		t.Error("h2 should not be explicit")
+	}
+	if n := h2.Count(); n != 3 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPClearReuse(t *testing.T) {
+	h, _ := NewPlus(8)
+	h.ClearReuse()
+	if h.sparse {
+		t.Error("ClearReuse should convert to normal")
+	}
+
+	for i := uint64(1); i <= 1000; i++ {
+		h.AddUint64(i * 0x9e3779b97f4a7c15)
+	}
+	reg := h.reg
+
+	h.ClearReuse()
+	if n := h.Count(); n != 0 {
+		t.Error(n)
+	}
+	if &h.reg[0] != &reg[0] {
+		t.Error("ClearReuse should reuse the registers")
+	}
+
+	h.Add(fakeHash64(0x010fffffffffffff))
+	h.Add(fakeHash64(0x020fffffffffffff))
+	if n := h.Count(); n != 2 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPDense(t *testing.T) {
+	d, err := NewPlusDense(14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := d.Mode(); m != "dense" {
+		t.Error(m)
+	}
+	if n := d.Count(); n != 0 {
+		t.Error(n)
+	}
+
+	// A sketch that goes through the explicit and sparse representations
+	// ends up with the same registers.
+	h, _ := NewPlus(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		x := r.Uint64()
+		d.AddUint64(x)
+		h.AddUint64(x)
+	}
+	if m := h.Mode(); m != "dense" {
+		t.Fatal(m)
+	}
+	if !reflect.DeepEqual(h.reg, d.reg) {
+		t.Error("registers differ")
+	}
+	if h.Count() != d.Count() {
+		t.Error(h.Count(), d.Count())
+	}
+
+	if _, err := NewPlusDense(3); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+}
+
+func BenchmarkHLLPPClearSparse(b *testing.B) {
+	xs := make([]uint64, 1e3)
+	for i := range xs {
+		xs[i] = rand.Uint64()
+	}
+
+	b.ReportAllocs()
+	h, _ := NewPlus(14)
+	for i := 0; i < b.N; i++ {
+		h.Clear()
+		for _, x := range xs {
+			h.AddUint64(x)
+		}
+	}
+}
+
+func BenchmarkHLLPPClearRefill(b *testing.B) {
+	xs := make([]uint64, 1e4)
+	for i := range xs {
+		xs[i] = rand.Uint64()
+	}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse=%t", reuse), func(b *testing.B) {
+			b.ReportAllocs()
+			h, _ := NewPlus(12)
+			for i := 0; i < b.N; i++ {
+				if reuse {
+					h.ClearReuse()
+				} else {
+					h.Clear()
+				}
+				for _, x := range xs {
+					h.AddUint64(x)
+				}
+			}
+		})
+	}
+}
+
+func TestHLLPPSparseHeadroom(t *testing.T) {
+	h, _ := NewPlus(12)
+	r := rand.New(rand.NewSource(1))
+
+	used, limit := h.SparseHeadroom()
+	if used != 0 || limit != 4096 {
+		t.Error(used, limit)
+	}
+
+	var lastUsed int
+	for h.sparse {
+		used, _ = h.SparseHeadroom()
+		if used < lastUsed {
+			t.Error("headroom grew", lastUsed, used)
+		}
+		lastUsed = used
+		h.AddUint64(r.Uint64())
+	}
+
+	// Just before the conversion there was little headroom left.
+	if lastUsed < limit*9/10 || lastUsed > limit {
+		t.Error(lastUsed)
+	}
+	if used, limit = h.SparseHeadroom(); used != limit {
+		t.Error(used, limit)
+	}
+
+	// With a sparse byte budget the limit is the budget, which the list
+	// never exceeds once merged.
+	h, _ = NewPlus(12, WithMaxSparseBytes(300))
+	if _, limit = h.SparseHeadroom(); limit != 300 {
+		t.Error(limit)
+	}
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(r.Uint64())
+		if !h.explicit {
+			h.mergeSparse()
+		}
+		if used, limit = h.SparseHeadroom(); used > limit || limit != 300 {
+			t.Fatal(i, used, limit)
+		}
+	}
+}
+
+func TestHLLPPMergeInto(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	small, _ := NewPlus(14)
+	for i := 0; i < 500; i++ {
+		small.AddUint64(r.Uint64())
+	}
+	large, _ := NewPlus(14)
+	for i := 0; i < 1e5; i++ {
+		large.AddUint64(r.Uint64())
+	}
+	large2, _ := NewPlus(14)
+	large2.Merge(large)
+
+	if err := small.MergeInto(large); err != nil {
+		t.Fatal(err)
+	}
+	if err := large2.Merge(small); err != nil {
+		t.Fatal(err)
+	}
+	if !small.sparse {
+		t.Error("MergeInto should not modify h")
+	}
+	if !reflect.DeepEqual(large.reg, large2.reg) {
+		t.Error("MergeInto differs from Merge")
+	}
+	if large.Count() != large2.Count() {
+		t.Error(large.Count(), large2.Count())
+	}
+
+	other, _ := NewPlus(10)
+	if err := small.MergeInto(other); err == nil {
+		t.Error("different precision should return error")
+	}
+}
+
+func TestHLLPPCompact(t *testing.T) {
+	h := newPlusSparse(14)
+	r := rand.New(rand.NewSource(1))
+
+	// Fill tmpSet directly to simulate a large transient batch.
+	for i := 0; i < 1000; i++ {
+		h.tmpSet.Add(h.encodeHash(r.Uint64()))
+	}
+	n := h.Count()
+	h.Compact()
+	if !h.sparse {
+		t.Fatal("Compact should not convert to normal")
+	}
+	if len(h.tmpSet) != 0 {
+		t.Error(len(h.tmpSet))
+	}
+	if c := cap(h.sparseList.b); c != len(h.sparseList.b) {
+		t.Error(c, len(h.sparseList.b))
+	}
+	if m := h.Count(); m != n {
+		t.Error(n, m)
+	}
+
+	for i := 0; i < 100; i++ {
+		h.Add(fakeHash64(r.Uint64()))
+	}
+	if m := h.Count(); m < n+90 || m > n+110 {
+		t.Error(n, m)
+	}
+}
+
+func TestHLLPPForEachSparse(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{10, 1000, 100000} {
+		h, _ := NewPlus(14)
+		for i := 0; i < n; i++ {
+			h.Add(fakeHash64(r.Uint64()))
+		}
+		sparse := h.sparse
+
+		var got [][2]uint32
+		h.ForEachSparse(func(i uint32, r uint8) {
+			got = append(got, [2]uint32{i, uint32(r)})
+		})
+		if h.sparse != sparse {
+			t.Error(n, "ForEachSparse changed the representation")
+		}
+
+		if h.sparse {
+			h.mergeSparseAndToNormal()
+		}
+		var want [][2]uint32
+		for i, r := range h.reg {
+			if r != 0 {
+				want = append(want, [2]uint32{uint32(i), uint32(r)})
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Error(n, len(got), len(want))
+		}
+	}
+
+	// Pending hashes that take the list past the normal threshold once merged
+	// do not convert h.
+	h := newPlusSparse(10)
+	for h.sparseList.Len()+len(h.tmpSet) <= int(h.m) {
+		h.tmpSet.Add(h.encodeHash(r.Uint64()))
+	}
+	var got []uint32
+	h.ForEachSparse(func(i uint32, r uint8) {
+		got = append(got, i)
+	})
+	if !h.sparse || len(h.tmpSet) != 0 || h.sparseList.Len() <= int(h.m) {
+		t.Error(h.Mode(), len(h.tmpSet), h.sparseList.Len())
+	}
+	h.mergeSparseAndToNormal()
+	if want := h.m - countZeros(h.reg); uint32(len(got)) != want {
+		t.Error(len(got), want)
+	}
+}
+
+func TestHLLPPMode(t *testing.T) {
+	h, _ := NewPlus(10)
+	if m := h.Mode(); m != "exact" {
+		t.Error(m)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i <= explicitThreshold; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	if m := h.Mode(); m != "sparse" {
+		t.Error(m)
+	}
+
+	for i := 0; i < 10000 && h.sparse; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	if m := h.Mode(); m != "dense" {
+		t.Error(m)
+	}
+}
+
+func TestHLLPPSizeBytes(t *testing.T) {
+	h, _ := NewPlus(14)
+	if n := h.SizeBytes(); n != 0 {
+		t.Error(n)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	last := 0
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 300; j++ {
+			h.AddUint64(r.Uint64())
+		}
+		if !h.sparse {
+			t.Fatal("h should still be sparse")
+		}
+		n := h.SizeBytes()
+		if n <= last {
+			t.Error(i, last, n)
+		}
+		last = n
+	}
+
+	h.mergeSparseAndToNormal()
+	if n := h.SizeBytes(); n != 1<<14 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPCompensatedSum(t *testing.T) {
+	h, _ := NewPlus(18, WithCompensatedSum())
+	h.mergeSparseAndToNormal()
+	h.reg = driftingRegisters()
+
+	est := estimateFromSum(h.m, exactRegisterSum(h.reg))
+	want := uint64(est - h.estimateBias(est))
+	if n := h.Count(); n != want {
+		t.Error(n, want)
+	}
+}
+
+func TestHLLPPReprecision(t *testing.T) {
+	coarse := newPlusSparse(14)
+	fine := newPlusSparse(18)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		x := r.Uint64()
+		coarse.AddUint64(x)
+		fine.AddUint64(x)
+	}
+	if !coarse.sparse {
+		t.Fatal("coarse should still be sparse")
+	}
+
+	if err := coarse.Reprecision(18); err != nil {
+		t.Fatal(err)
+	}
+	if coarse.p != 18 || !coarse.sparse {
+		t.Error(coarse.p, coarse.Mode())
+	}
+	if c, f := coarse.Count(), fine.Count(); math.Abs(float64(c)-float64(f)) > 0.001*float64(f) {
+		t.Error(c, f)
+	}
+
+	// Both keep working as sketches of the new precision.
+	for i := 0; i < 3000; i++ {
+		x := r.Uint64()
+		coarse.AddUint64(x)
+		fine.AddUint64(x)
+	}
+	if c, f := coarse.Count(), fine.Count(); math.Abs(float64(c)-float64(f)) > 0.001*float64(f) {
+		t.Error(c, f)
+	}
+
+	if err := coarse.Reprecision(12); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+	coarse.mergeSparseAndToNormal()
+	if err := coarse.Reprecision(18); err == nil {
+		t.Error("expected an error for a normal sketch")
+	}
+}
+
+func TestHLLPPReprecisionExplicit(t *testing.T) {
+	coarse, _ := NewPlus(8)
+	fine, _ := NewPlus(14)
+	for i := 0; i < 50; i++ {
+		x := rand.Uint64()
+		coarse.AddUint64(x)
+		fine.AddUint64(x)
+	}
+
+	if err := coarse.Reprecision(14); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(coarse.DenseRegisters(), fine.DenseRegisters()) {
+		t.Error("registers differ")
+	}
+	if c := coarse.Count(); c != 50 {
+		t.Error(c)
+	}
+}
+
+func TestHLLPPSparseFold(t *testing.T) {
+	h := newPlusSparse(14)
+	coarse, _ := NewPlus(14, WithExplicitThreshold(0), WithSparsePrecision(18))
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		x := r.Uint64()
+		h.AddUint64(x)
+		coarse.AddUint64(x)
+	}
+
+	if err := h.SparseFold(18); err != nil {
+		t.Fatal(err)
+	}
+	if h.sparseP != 18 || !h.sparse {
+		t.Error(h.sparseP, h.Mode())
+	}
+
+	// Folding gives the same keys as adding the hashes at the lower sparse
+	// precision, whose count has a larger error.
+	h.Compact()
+	coarse.Compact()
+	if !slices.Equal(h.sparseList.b, coarse.sparseList.b) {
+		t.Error("sparse lists differ")
+	}
+	if c := h.Count(); c != coarse.Count() || math.Abs(float64(c)-5000) > 0.02*5000 {
+		t.Error(c, coarse.Count())
+	}
+
+	if err := h.SparseFold(14); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+	if err := h.SparseFold(19); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+	h.mergeSparseAndToNormal()
+	if err := h.SparseFold(16); err == nil {
+		t.Error("expected an error for a normal sketch")
+	}
+}
+
+func TestHLLPPMaxSparseBytes(t *testing.T) {
+	const budget = 4000
+	h, _ := NewPlus(14, WithExplicitThreshold(0), WithMaxSparseBytes(budget))
+	r := rand.New(rand.NewSource(1))
+	added := 0
+	for _, n := range []int{500, 1000, 2000} {
+		for ; added < n; added++ {
+			h.AddUint64(r.Uint64())
+		}
+		h.Compact()
+		if b := h.SparseBytes(); !h.sparse || b > budget {
+			t.Error(n, h.Mode(), b)
+		}
+		if c := h.Count(); math.Abs(float64(c)-float64(n)) > 0.02*float64(n) {
+			t.Error(n, c)
+		}
+	}
+	if h.sparseP == pPrime {
+		t.Error("h should have been folded")
+	}
+
+	// Without a budget the list grows past it.
+	u, _ := NewPlus(14, WithExplicitThreshold(0))
+	for i := 0; i < added; i++ {
+		u.AddUint64(r.Uint64())
+	}
+	u.Compact()
+	if b := u.SparseBytes(); b <= budget {
+		t.Error(b)
+	}
+
+	// Far more items than the budget holds keep the encoded list within it,
+	// lowering the precision once nothing is left to fold, and never make h
+	// normal.
+	for ; added < 1e5; added++ {
+		h.AddUint64(r.Uint64())
+		if b := h.SparseBytes(); !h.sparse || b > budget {
+			t.Fatal(added, h.Mode(), b)
+		}
+	}
+	if h.p >= 14 || h.sparseP >= pPrime {
+		t.Error(h.p, h.sparseP)
+	}
+	if c := h.Count(); c < 5e4 || c > 2e5 {
+		t.Error(c)
+	}
+
+	// The smallest budget holds any number of items.
+	tiny, _ := NewPlus(14, WithMaxSparseBytes(minSparseBytes))
+	for i := 0; i < 1e5; i++ {
+		tiny.AddUint64(r.Uint64())
+		if b := tiny.SparseBytes(); !tiny.sparse || b > minSparseBytes {
+			t.Fatal(i, tiny.Mode(), b)
+		}
+	}
+	if _, err := NewPlus(14, WithMaxSparseBytes(minSparseBytes-1)); err == nil {
+		t.Error("a budget below minSparseBytes should be rejected")
+	}
+
+	// Clear restores both precisions, so h merges with a fresh sketch
+	// without converting to normal.
+	h.Clear()
+	if h.p != 14 || h.m != 1<<14 || h.sparseP != pPrime {
+		t.Error(h.p, h.m, h.sparseP)
+	}
+	fresh, _ := NewPlus(14, WithExplicitThreshold(0))
+	h.AddUint64(r.Uint64())
+	fresh.AddUint64(r.Uint64())
+	if err := h.Merge(fresh); err != nil || !h.sparse {
+		t.Error(err, h.Mode())
+	}
+
+	// Merging a sketch of another sparse precision folds rather than
+	// converting h, and normal registers are refused.
+	folded, _ := NewPlus(14, WithExplicitThreshold(0), WithSparsePrecision(20))
+	folded.AddUint64(r.Uint64())
+	if err := h.Merge(folded); err != nil || !h.sparse || h.sparseP != 20 || h.Count() != 3 {
+		t.Error(err, h.Mode(), h.sparseP, h.Count())
+	}
+	dense, _ := NewPlusDense(14)
+	if err := h.Merge(dense); err == nil || !h.sparse {
+		t.Error(err, h.Mode())
+	}
+	if err := MergeInterop(h, dense); err == nil || !h.sparse {
+		t.Error(err, h.Mode())
+	}
+}
+
+func TestHLLPPPromotion(t *testing.T) {
+	// Record every representation a sketch goes through while adding the
+	// same deterministic hashes, checking that each Add leaves nothing to
+	// promote.
+	type state struct {
+		mode       string
+		p, sparseP uint8
+	}
+	ladder := func(h *HyperLogLogPlus, limit int) []state {
+		states := []state{{h.Mode(), h.p, h.sparseP}}
+		for i := uint64(1); h.sparse && i <= 20000; i++ {
+			h.AddUint64(i * 0x9e3779b97f4a7c15)
+			if p := h.nextPromotion(); p != promoteNone {
+				t.Fatal(i, p)
+			}
+			if s := (state{h.Mode(), h.p, h.sparseP}); s != states[len(states)-1] {
+				states = append(states, s)
+			}
+			if h.sparse && h.sparseList.Len() > limit {
+				t.Fatal(i, h.sparseList.Len())
+			}
+		}
+		return states
+	}
+
+	// Within its budget the sketch goes down the ladder once: explicit,
+	// sparse, folded to lower sparse precisions, several bits at a time when
+	// one is not enough to fit the list within its budget, then lowering the
+	// precision, never becoming dense.
+	h, _ := NewPlus(10, WithExplicitThreshold(4), WithMaxSparseBytes(200))
+	if p := h.nextPromotion(); p != promoteNone {
+		t.Error(p)
+	}
+	got := ladder(h, 200)
+	want := []state{
+		{"exact", 10, 25}, {"sparse", 10, 25}, {"sparse", 10, 19}, {"sparse", 10, 12},
+		{"sparse", 9, 11}, {"sparse", 8, 10}, {"sparse", 6, 8}, {"sparse", 5, 7},
+		{"sparse", 5, 6}, {"sparse", 4, 6}, {"sparse", 4, 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(got)
+	}
+
+	// Without one it becomes dense once the list outgrows the threshold.
+	h, _ = NewPlus(10, WithExplicitThreshold(4), WithNormalThreshold(600))
+	got = ladder(h, 600)
+	want = []state{{"exact", 10, 25}, {"sparse", 10, 25}, {"dense", 10, 25}}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(got)
+	}
+
+	// Each step of the ladder is chosen on its own.
+	budget := []PlusOption{WithExplicitThreshold(4), WithMaxSparseBytes(200)}
+	for _, tc := range []struct {
+		opts  []PlusOption
+		setup func(h *HyperLogLogPlus)
+		want  promotion
+	}{
+		{budget, func(h *HyperLogLogPlus) { h.explicitSet = make([]uint64, 5) }, promoteSparse},
+		{budget, func(h *HyperLogLogPlus) { h.toSparse(); h.tmpSet = set{1: true, 3: true} }, promoteNone},
+		{budget, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			for k := uint32(0); k < 11; k++ {
+				h.tmpSet.Add(k << 1)
+			}
+		}, promoteFlush},
+		{budget, func(h *HyperLogLogPlus) { h.toSparse(); h.sparseList.b = make(variableLengthList, 201) }, promoteFold},
+		{budget, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			h.sparseP = h.p + 1
+			h.sparseList.b = make(variableLengthList, 201)
+		}, promoteShrink},
+		{budget, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			h.p, h.m, h.sparseP = 4, 16, 5
+			h.sparseList.b = make(variableLengthList, 201)
+		}, promoteCompact},
+		{nil, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			h.sparseList.b = make(variableLengthList, 1025)
+		}, promoteNormal},
+		{nil, func(h *HyperLogLogPlus) {
+			// A list of unusually close keys, smaller than the registers,
+			// still becomes normal past the cutoff.
+			h.toSparse()
+			h.sparseList.b = make(variableLengthList, 400)
+			h.sparseList.Count = uint32(OptimalSparseCutoff(10)) + 1
+		}, promoteNormal},
+		{nil, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			h.sparseList.b = make(variableLengthList, 400)
+			h.sparseList.Count = uint32(OptimalSparseCutoff(10))
+		}, promoteNone},
+		{[]PlusOption{WithSparsePrecision(20)}, func(h *HyperLogLogPlus) {
+			h.toSparse()
+			h.sparseList.b = make(variableLengthList, 400)
+			h.sparseList.Count = uint32(OptimalSparseCutoff(10)) + 1
+		}, promoteNone},
+		{nil, func(h *HyperLogLogPlus) { h.toNormal() }, promoteNone},
+	} {
+		h, _ := NewPlus(10, tc.opts...)
+		tc.setup(h)
+		if p := h.nextPromotion(); p != tc.want {
+			t.Error(p, tc.want)
+		}
+	}
+}
+
+func TestOptimalSparseCutoff(t *testing.T) {
+	for _, p := range []uint8{8, 12, 14} {
+		cutoff := OptimalSparseCutoff(p)
+		m := 1 << p
+		if cutoff < m/8 || cutoff > m {
+			t.Fatal(p, cutoff)
+		}
+
+		// Just below the cutoff the sparse list is smaller than the
+		// registers, and just above it the sketch has become normal.
+		h, _ := NewPlus(p, WithExplicitThreshold(0))
+		r := rand.New(rand.NewSource(int64(p)))
+		for i := 0; i < cutoff*9/10; i++ {
+			h.AddUint64(r.Uint64())
+		}
+		h.Compact()
+		if !h.sparse || h.SparseBytes() > m {
+			t.Error(p, cutoff, h.Mode(), h.SparseBytes())
+		}
+		for i := cutoff * 9 / 10; i < cutoff*11/10; i++ {
+			h.AddUint64(r.Uint64())
+		}
+		h.Compact()
+		if h.sparse {
+			t.Error(p, cutoff, h.SparseBytes())
+		}
+	}
+	if n := OptimalSparseCutoff(3); n != 0 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPSparseBytes(t *testing.T) {
+	h, _ := NewPlus(18)
+	if n := h.SparseBytes(); n != 0 {
+		t.Error(n)
+	}
+
+	// Deltas between sorted hashes shrink as the list fills, so each new
+	// hash takes fewer bytes than the ones before it.
+	r := rand.New(rand.NewSource(1))
+	added := 0
+	var perHash []float64
+	for _, n := range []int{500, 5000, 50000} {
+		for ; added < n; added++ {
+			h.AddUint64(r.Uint64())
+		}
+		h.Compact()
+		if !h.sparse {
+			t.Fatal("h should still be sparse")
+		}
+		perHash = append(perHash, float64(h.SparseBytes())/float64(n))
+	}
+	for i := 1; i < len(perHash); i++ {
+		if perHash[i] >= perHash[i-1] {
+			t.Error(perHash)
+		}
+	}
+
+	h.mergeSparseAndToNormal()
+	if n := h.SparseBytes(); n != 0 {
+		t.Error(n)
+	}
+}
+
+func TestHLLPPSparseGrows(t *testing.T) {
+	h := newPlusSparse(18)
+	if c := cap(h.sparseList.b); c > sparseInitialCapacity {
+		t.Error(c)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	last := cap(h.sparseList.b)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5000; j++ {
+			h.AddUint64(r.Uint64())
+		}
+		h.mergeSparse()
+		c := cap(h.sparseList.b)
+		if c <= last || c > 2*h.sparseList.Len()+sparseInitialCapacity {
+			t.Error(i, last, c, h.sparseList.Len())
+		}
+		last = c
+	}
+}
+
+func TestHLLPPCountAcrossPromotion(t *testing.T) {
+	// The sweep ends before linear counting gives way to the bias corrected
+	// estimate at threshold[12-4], a jump of its own.
+	for seed := uint64(0); seed < 10; seed++ {
+		h, _ := NewPlus(12)
+		var last, promoted uint64
+		for i := uint64(1); promoted == 0 || i < promoted*19/10; i++ {
+			h.AddUint64(fmix64(i ^ seed<<40))
+			n := h.Count()
+			if promoted == 0 && !h.sparse {
+				promoted = i
+				if n > last+1 {
+					t.Errorf("seed %d: count jumped from %d to %d at promotion", seed, last, n)
+				}
+			}
+			if n < last {
+				t.Errorf("seed %d: count dropped from %d to %d at %d", seed, last, n, i)
+			}
+			if e := math.Abs(float64(n)-float64(i)) / float64(i); e > 0.05 {
+				t.Errorf("seed %d: count %d for %d items", seed, n, i)
+			}
+			last = n
+		}
+	}
+}
+
+func TestHLLPPBlendMonotonic(t *testing.T) {
+	// Corrections larger than the normal estimate at the conversion, up or
+	// down, still never make the count drop as the normal estimate grows.
+	for _, offset := range []float64{-500, -50, 0, 50, 1000, 5000} {
+		h := &HyperLogLogPlus{blendBase: 1000, blendOffset: offset}
+		last := h.blend(0)
+		for est := uint64(1); est < 10000; est++ {
+			n := h.blend(est)
+			if n < last {
+				t.Fatalf("offset %v: count dropped from %d to %d at %d", offset, last, n, est)
+			}
+			last = n
+		}
+		if n := h.blend(1000); n != uint64(max(1000+offset, 0)) {
+			t.Error(offset, n)
+		}
+		if n := h.blend(9000); n != 9000 {
+			t.Error(offset, n)
+		}
+	}
+}
+
+func TestHLLPPAdaptive(t *testing.T) {
+	if _, err := NewAdaptive(12, 10); !errors.Is(err, ErrInvalidPrecision) {
+		t.Error(err)
+	}
+
+	h, err := NewAdaptive(10, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	precisions := []uint8{h.p}
+	for i := uint64(1); i <= 100000; i++ {
+		h.AddUint64(fmix64(i))
+		if p := h.p; p != precisions[len(precisions)-1] {
+			if !h.sparse && p != 14 {
+				t.Errorf("normal at precision %d after %d items", p, i)
+			}
+			precisions = append(precisions, p)
+		}
+		if i%1000 != 0 {
+			continue
+		}
+		tolerance := 0.01
+		if !h.sparse {
+			tolerance = 0.03
+		}
+		if e := math.Abs(float64(h.Count())-float64(i)) / float64(i); e > tolerance {
+			t.Errorf("count %d for %d items at precision %d", h.Count(), i, h.p)
+		}
+	}
+	if !slices.Equal(precisions, []uint8{10, 11, 12, 13, 14}) || h.sparse {
+		t.Error(precisions, h.sparse)
+	}
+
+	h.Clear()
+	if h.p != 10 || h.m != 1<<10 || h.Count() != 0 {
+		t.Error(h.p, h.m, h.Count())
+	}
+}
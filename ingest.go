@@ -0,0 +1,105 @@
+package hyperloglog
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CountColumn returns the estimated number of distinct values in column col,
+// counting from 0, of the delimited records read from r, such as CSV with ','
+// or TSV with '\t'. Records are read one at a time with encoding/csv, so the
+// input is never held in memory, and each value is added to a HyperLogLog64 of
+// the given precision with AddString.
+func CountColumn(r io.Reader, delimiter rune, col int, precision uint8) (uint64, error) {
+	h, err := New64(precision)
+	if err != nil {
+		return 0, err
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comma = delimiter
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if col < 0 || col >= len(record) {
+			line, _ := cr.FieldPos(0)
+			return 0, fmt.Errorf("record on line %d has no column %d", line, col)
+		}
+		h.AddString(record[col])
+	}
+	return h.Count(), nil
+}
+
+// CountFiles returns the estimated number of distinct lines across the files
+// at paths, such as the arguments of a command line tool. Every line of every
+// file is added with AddBytes to a single HyperLogLog64 of the given
+// precision, so a line found in several files is counted once. A file that
+// cannot be opened or read does not stop the count: the remaining files are
+// still counted, and the failures are returned joined in a non-nil error
+// alongside the estimate.
+func CountFiles(paths []string, precision uint8) (uint64, error) {
+	h, err := New64(precision)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, path := range paths {
+		if err := addLines(h, path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return h.Count(), errors.Join(errs...)
+}
+
+// Adds each line of the file at path to h.
+func addLines(h *HyperLogLog64, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := h.AddReaderContext(context.Background(), f); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// cancelCheckInterval is the number of lines AddReaderContext adds between
+// checks of its context.
+const cancelCheckInterval = 1024
+
+// AddReaderContext adds each line read from r to HyperLogLog64 h with AddBytes
+// and returns the number of lines added. Every cancelCheckInterval lines it
+// checks ctx, and once ctx is done it stops and returns ctx.Err(). The lines
+// added until then are kept in h, so a cancelled ingestion leaves a sketch of
+// the input read so far.
+func (h *HyperLogLog64) AddReaderContext(ctx context.Context, r io.Reader) (int, error) {
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		h.AddBytes(sc.Bytes())
+		n++
+		if n%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return n, err
+	}
+	return n, ctx.Err()
+}
@@ -0,0 +1,91 @@
+package hyperloglog
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountColumn(t *testing.T) {
+	const data = `id,country,city
+1,FR,Paris
+2,DE,Berlin
+3,FR,Lyon
+4,"US",New York
+5,DE,Munich
+6,ES,"Madrid, Spain"
+`
+	n, err := CountColumn(strings.NewReader(data), ',', 1, 14)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), n) // the header and FR, DE, US, ES
+
+	n, err = CountColumn(strings.NewReader(strings.ReplaceAll(data, ",", "\t")), '\t', 0, 14)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), n)
+
+	_, err = CountColumn(strings.NewReader(data), ',', 3, 14)
+	require.EqualError(t, err, "record on line 1 has no column 3")
+}
+
+func TestCountFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	require.NoError(t, os.WriteFile(a, []byte("alice\nbob\ncarol\nbob\n"), 0o600))
+	require.NoError(t, os.WriteFile(b, []byte("carol\ndave\nalice\neve"), 0o600))
+
+	n, err := CountFiles([]string{a, b}, 14)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), n)
+
+	// A missing file is reported, but the others are still counted.
+	n, err = CountFiles([]string{a, filepath.Join(dir, "missing.txt"), b}, 14)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, uint64(5), n)
+
+	_, err = CountFiles([]string{a}, 3)
+	require.Error(t, err)
+}
+
+// lineReader produces the lines "0", "1", ... without end, and calls cancel
+// once it has produced cancelAfter of them.
+type lineReader struct {
+	next, cancelAfter int
+	cancel            func()
+	buf               []byte
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) {
+		r.buf = fmt.Appendf(r.buf, "%d\n", r.next)
+		r.next++
+		if r.next == r.cancelAfter {
+			r.cancel()
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func TestAddReaderContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h, _ := New64(14)
+	n, err := h.AddReaderContext(ctx, &lineReader{cancelAfter: 10000, cancel: cancel})
+	require.ErrorIs(t, err, context.Canceled)
+	require.GreaterOrEqual(t, n, 10000-cancelCheckInterval)
+	require.Zero(t, n%cancelCheckInterval)
+	require.InEpsilon(t, n, h.Count(), 0.03)
+
+	h.Clear()
+	n, err = h.AddReaderContext(context.Background(), strings.NewReader("a\nb\na\n"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, uint64(2), h.Count())
+}
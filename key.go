@@ -0,0 +1,50 @@
+package hyperloglog
+
+import "encoding/binary"
+
+// KeyBuilder builds a stable hash for a key made of several typed fields, for
+// use with AddUint64. Each field is written with its type and length, so keys
+// such as ("a", "b") and ("ab", "") hash differently. The hash is the same one
+// used by AddBytes, so it does not change between runs or machines.
+//
+// The zero value is an empty key.
+type KeyBuilder struct {
+	buf []byte
+}
+
+const (
+	keyUint64 byte = iota + 1
+	keyString
+	keyBytes
+)
+
+// WriteUint64 appends an integer field to the key.
+func (k *KeyBuilder) WriteUint64(v uint64) {
+	k.buf = append(k.buf, keyUint64)
+	k.buf = binary.BigEndian.AppendUint64(k.buf, v)
+}
+
+// WriteString appends a string field to the key.
+func (k *KeyBuilder) WriteString(s string) {
+	k.buf = append(k.buf, keyString)
+	k.buf = binary.AppendUvarint(k.buf, uint64(len(s)))
+	k.buf = append(k.buf, s...)
+}
+
+// WriteBytes appends a byte slice field to the key.
+func (k *KeyBuilder) WriteBytes(b []byte) {
+	k.buf = append(k.buf, keyBytes)
+	k.buf = binary.AppendUvarint(k.buf, uint64(len(b)))
+	k.buf = append(k.buf, b...)
+}
+
+// Sum64 returns the hash of the fields written so far. KeyBuilder implements
+// Hash64, so it can also be passed to Add.
+func (k *KeyBuilder) Sum64() uint64 {
+	return hashBytes(k.buf)
+}
+
+// Reset empties the key, keeping its buffer for reuse.
+func (k *KeyBuilder) Reset() {
+	k.buf = k.buf[:0]
+}
@@ -0,0 +1,39 @@
+package hyperloglog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyBuilderDelimitsFields(t *testing.T) {
+	var k KeyBuilder
+	k.WriteString("a")
+	k.WriteString("b")
+	ab := k.Sum64()
+
+	k.Reset()
+	k.WriteString("ab")
+	k.WriteString("")
+	require.NotEqual(t, ab, k.Sum64())
+
+	// The same bytes written as a different type must not collide either.
+	k.Reset()
+	k.WriteBytes([]byte("a"))
+	k.WriteBytes([]byte("b"))
+	require.NotEqual(t, ab, k.Sum64())
+}
+
+func TestKeyBuilderStable(t *testing.T) {
+	var k1, k2 KeyBuilder
+	k1.WriteUint64(42)
+	k1.WriteString("2024-01-01")
+	k2.WriteUint64(42)
+	k2.WriteString("2024-01-01")
+	require.Equal(t, k1.Sum64(), k2.Sum64())
+
+	h, _ := NewPlus(14)
+	h.Add(&k1)
+	h.AddUint64(k2.Sum64())
+	require.Equal(t, uint64(1), h.Count())
+}
@@ -0,0 +1,71 @@
+package hyperloglog
+
+import "errors"
+
+// MonitoredHLL wraps a HyperLogLog64 and keeps statistics of how its count
+// changes between calls to CountMonitored, to tell steady growth apart from
+// sudden jumps that may indicate corruption or a bad merge. It stores no
+// samples, so monitoring takes constant memory and does not allocate.
+type MonitoredHLL struct {
+	*HyperLogLog64
+
+	weight float64
+	stats  DriftStats
+}
+
+// DriftStats summarizes the changes between consecutive counts of a
+// MonitoredHLL.
+type DriftStats struct {
+	// Samples is the number of calls to CountMonitored.
+	Samples int
+
+	// Last is the most recent count.
+	Last uint64
+
+	// MaxDelta is the largest absolute change between two consecutive
+	// counts.
+	MaxDelta uint64
+
+	// EWMA is the exponentially weighted moving average of the absolute
+	// change between consecutive counts.
+	EWMA float64
+}
+
+// NewMonitoredHLL returns a MonitoredHLL wrapping h. weight, between 0 and 1,
+// is the weight of the newest change in the moving average; larger weights
+// forget older changes faster.
+func NewMonitoredHLL(h *HyperLogLog64, weight float64) (*MonitoredHLL, error) {
+	if !(weight > 0 && weight <= 1) {
+		return nil, errors.New("weight must be in (0, 1]")
+	}
+	return &MonitoredHLL{HyperLogLog64: h, weight: weight}, nil
+}
+
+// CountMonitored returns the cardinality estimate like Count and records the
+// change since the previous call in the drift statistics. The first call only
+// records the count.
+func (m *MonitoredHLL) CountMonitored() uint64 {
+	n := m.Count()
+	if m.stats.Samples > 0 {
+		var delta uint64
+		if last := m.stats.Last; n > last {
+			delta = n - last
+		} else {
+			delta = last - n
+		}
+		m.stats.MaxDelta = max(m.stats.MaxDelta, delta)
+		if m.stats.Samples == 1 {
+			m.stats.EWMA = float64(delta)
+		} else {
+			m.stats.EWMA += m.weight * (float64(delta) - m.stats.EWMA)
+		}
+	}
+	m.stats.Samples++
+	m.stats.Last = n
+	return n
+}
+
+// DriftStats returns the drift statistics recorded by CountMonitored.
+func (m *MonitoredHLL) DriftStats() DriftStats {
+	return m.stats
+}
@@ -0,0 +1,46 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitoredHLL(t *testing.T) {
+	h, _ := New64(14)
+	m, err := NewMonitoredHLL(h, 0.2)
+	require.NoError(t, err)
+	require.Zero(t, m.CountMonitored())
+
+	// Steady growth of 1000 items between samples.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 1000; j++ {
+			m.AddUint64(r.Uint64())
+		}
+		m.CountMonitored()
+	}
+	steady := m.DriftStats()
+	require.Equal(t, 21, steady.Samples)
+	require.InEpsilon(t, 1000, steady.EWMA, 0.2)
+	require.Less(t, steady.MaxDelta, uint64(1300))
+
+	// A merge of a large sketch shows up as a spike.
+	big, _ := New64(14)
+	for j := 0; j < 1e5; j++ {
+		big.AddUint64(r.Uint64())
+	}
+	require.NoError(t, m.Merge(big))
+	n := m.CountMonitored()
+
+	spike := m.DriftStats()
+	require.Equal(t, n, spike.Last)
+	require.Equal(t, n-steady.Last, spike.MaxDelta)
+	require.Greater(t, spike.MaxDelta, uint64(9e4))
+	require.Greater(t, spike.EWMA, steady.EWMA+0.2*8e4)
+	require.Less(t, spike.EWMA, float64(spike.MaxDelta))
+
+	_, err = NewMonitoredHLL(h, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package hyperloglog
+
+// MultiHLL holds one HyperLogLog64 per name, such as one per column of a
+// record, so that distinct values can be counted for each name and over all
+// of them together.
+type MultiHLL struct {
+	p        uint8
+	sketches map[string]*HyperLogLog64
+}
+
+// NewMultiHLL returns a new MultiHLL whose sketches have the given precision.
+func NewMultiHLL(precision uint8) (*MultiHLL, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
+	}
+	return &MultiHLL{p: precision, sketches: map[string]*HyperLogLog64{}}, nil
+}
+
+// Add adds hash x to the sketch of MultiHLL s for name, creating it if needed.
+func (s *MultiHLL) Add(name string, x uint64) {
+	h, ok := s.sketches[name]
+	if !ok {
+		h, _ = New64(s.p)
+		s.sketches[name] = h
+	}
+	h.AddUint64(x)
+}
+
+// Sketch returns the sketch of MultiHLL s for name, or nil if nothing was
+// added for it.
+func (s *MultiHLL) Sketch(name string) *HyperLogLog64 {
+	return s.sketches[name]
+}
+
+// Count returns the cardinality estimate for name.
+func (s *MultiHLL) Count(name string) uint64 {
+	if h, ok := s.sketches[name]; ok {
+		return h.Count()
+	}
+	return 0
+}
+
+// CountAll returns the cardinality estimate of the union of all sketches of
+// MultiHLL s.
+func (s *MultiHLL) CountAll() uint64 {
+	u, _ := New64(s.p)
+	for _, h := range s.sketches {
+		u.Merge(h)
+	}
+	return u.Count()
+}
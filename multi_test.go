@@ -0,0 +1,35 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiHLL(t *testing.T) {
+	s, err := NewMultiHLL(14)
+	require.NoError(t, err)
+
+	// 3e4 values only in "a", 2e4 only in "b" and 1e4 in both.
+	add := func(n int, names ...string) {
+		for i := 0; i < n; i++ {
+			x := rand.Uint64()
+			for _, name := range names {
+				s.Add(name, x)
+			}
+		}
+	}
+	add(3e4, "a")
+	add(2e4, "b")
+	add(1e4, "a", "b")
+
+	require.InEpsilon(t, 4e4, s.Count("a"), 0.03)
+	require.InEpsilon(t, 3e4, s.Count("b"), 0.03)
+	require.InEpsilon(t, 6e4, s.CountAll(), 0.03)
+	require.Zero(t, s.Count("c"))
+	require.Nil(t, s.Sketch("c"))
+
+	_, err = NewMultiHLL(3)
+	require.ErrorIs(t, err, ErrInvalidPrecision)
+}
@@ -0,0 +1,112 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Storage types of the postgresql-hll extension.
+const (
+	pgTypeUndefined = 0
+	pgTypeEmpty     = 1
+	pgTypeExplicit  = 2
+	pgTypeSparse    = 3
+	pgTypeFull      = 4
+)
+
+// FromPostgresHLL decodes a sketch serialized by the postgresql-hll extension
+// (https://github.com/citusdata/postgresql-hll), as produced by hll_add_agg,
+// into a HyperLogLog64 with precision log2m. The empty, explicit, sparse and
+// full storage types are supported.
+//
+// postgresql-hll uses the low log2m bits of a hash as the register index and
+// the trailing zeros of the rest as the rank, while HyperLogLog64 uses the high
+// bits and leading zeros. The decoded sketch estimates the same cardinality,
+// but should only be merged with other sketches decoded by FromPostgresHLL;
+// adding the same items to it through AddUint64 counts them again.
+func FromPostgresHLL(b []byte) (*HyperLogLog64, error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("postgres hll: %w: header too short", ErrInvalidEncoding)
+	}
+	if version := b[0] >> 4; version != 1 {
+		return nil, fmt.Errorf("postgres hll: %w: unsupported version %d", ErrInvalidEncoding, version)
+	}
+
+	typ := b[0] & 0x0f
+	regWidth := b[1]>>5 + 1
+	log2m := b[1] & 0x1f
+	data := b[3:]
+
+	h, err := New64(log2m)
+	if err != nil {
+		return nil, fmt.Errorf("postgres hll: %w", err)
+	}
+
+	switch typ {
+	case pgTypeEmpty:
+		if len(data) != 0 {
+			return nil, fmt.Errorf("postgres hll: %w: unexpected data in empty sketch", ErrInvalidEncoding)
+		}
+	case pgTypeExplicit:
+		if len(data)%8 != 0 {
+			return nil, fmt.Errorf("postgres hll: %w: explicit data is not a multiple of 8 bytes", ErrInvalidEncoding)
+		}
+		for i := 0; i < len(data); i += 8 {
+			h.addPostgresHash(binary.BigEndian.Uint64(data[i:]), regWidth)
+		}
+	case pgTypeSparse:
+		width := uint(log2m) + uint(regWidth)
+		n := uint(len(data)) * 8 / width
+		for i := uint(0); i < n; i++ {
+			v := readBitsMSB(data, i*width, width)
+			idx, r := v>>regWidth, uint8(v&(1<<regWidth-1))
+			if r > h.reg[idx] {
+				h.reg[idx] = r
+			}
+		}
+	case pgTypeFull:
+		if uint64(len(data))*8 < uint64(h.m)*uint64(regWidth) {
+			return nil, fmt.Errorf("postgres hll: %w: full data too short", ErrInvalidEncoding)
+		}
+		for i := range h.reg {
+			h.reg[i] = uint8(readBitsMSB(data, uint(i)*uint(regWidth), uint(regWidth)))
+		}
+	default:
+		return nil, fmt.Errorf("postgres hll: %w: unsupported type %d", ErrInvalidEncoding, typ)
+	}
+	h.registersChanged()
+	return h, nil
+}
+
+// Adds a raw hash the way postgresql-hll does: the low p bits select the
+// register and the rank is one more than the number of trailing zeros of the
+// remaining bits, capped to what a register of regWidth bits can hold.
+func (h *HyperLogLog64) addPostgresHash(x uint64, regWidth uint8) {
+	w := x >> h.p
+	if w == 0 {
+		return
+	}
+
+	var r uint8 = 1
+	for ; w&1 == 0; w >>= 1 {
+		r++
+	}
+	if max := uint8(1<<regWidth - 1); r > max {
+		r = max
+	}
+
+	i := x & uint64(h.m-1)
+	if r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+// Reads n bits starting at bit offset off of b, most significant bit first.
+func readBitsMSB(b []byte, off, n uint) uint64 {
+	var v uint64
+	for i := off; i < off+n; i++ {
+		bit := b[i/8] >> (7 - i%8) & 1
+		v = v<<1 | uint64(bit)
+	}
+	return v
+}
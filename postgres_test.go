@@ -0,0 +1,119 @@
+package hyperloglog
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func pgBytes(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// Packs values of width bits each, most significant bit first, as
+// postgresql-hll does for its sparse and full storage types.
+func writeBitsMSB(vs []uint64, width uint) []byte {
+	b := make([]byte, (uint(len(vs))*width+7)/8)
+	for i, v := range vs {
+		for j := uint(0); j < width; j++ {
+			if v>>(width-1-j)&1 == 1 {
+				off := uint(i)*width + j
+				b[off/8] |= 1 << (7 - off%8)
+			}
+		}
+	}
+	return b
+}
+
+func TestFromPostgresHLLEmpty(t *testing.T) {
+	// SELECT hll_empty();
+	h, err := FromPostgresHLL(pgBytes(t, "118b7f"))
+	require.NoError(t, err)
+	require.Equal(t, uint8(11), h.p)
+	require.Zero(t, h.Count())
+}
+
+func TestFromPostgresHLLExplicit(t *testing.T) {
+	// SELECT hll_add(hll_empty(), hll_hash_integer(1));
+	h, err := FromPostgresHLL(pgBytes(t, "128b7f8895a3f5af28cafe"))
+	require.NoError(t, err)
+	require.Equal(t, uint8(11), h.p)
+	require.Equal(t, uint8(1), h.reg[0x2fe])
+	require.Equal(t, uint64(1), h.Count())
+}
+
+func TestFromPostgresHLLFull(t *testing.T) {
+	reg := make([]uint64, 16)
+	for i := range reg {
+		reg[i] = uint64(i % 7)
+	}
+
+	// Version 1, full, regwidth 5, log2m 4.
+	b := append([]byte{0x14, 0x84, 0x7f}, writeBitsMSB(reg, 5)...)
+	h, err := FromPostgresHLL(b)
+	require.NoError(t, err)
+	for i, r := range reg {
+		require.Equal(t, uint8(r), h.reg[i])
+	}
+
+	_, err = FromPostgresHLL(b[:len(b)-2])
+	require.Error(t, err)
+}
+
+func TestFromPostgresHLLSparse(t *testing.T) {
+	// Version 1, sparse, regwidth 5, log2m 11.
+	entries := []uint64{3<<5 | 4, 100<<5 | 1, 2047<<5 | 31}
+	b := append([]byte{0x13, 0x8b, 0x7f}, writeBitsMSB(entries, 16)...)
+	h, err := FromPostgresHLL(b)
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), h.reg[3])
+	require.Equal(t, uint8(1), h.reg[100])
+	require.Equal(t, uint8(31), h.reg[2047])
+	require.Equal(t, uint64(3), h.Count())
+}
+
+func TestFromPostgresHLLMatchesExplicit(t *testing.T) {
+	// The same hashes stored explicitly and as full registers must decode to
+	// the same sketch.
+	const log2m, regWidth = 10, 5
+	explicit := []byte{0x12, (regWidth-1)<<5 | log2m, 0x7f}
+	h, _ := New64(log2m)
+	for i := 0; i < 5000; i++ {
+		x := rand.Uint64()
+		explicit = append(explicit, byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+			byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+		h.addPostgresHash(x, regWidth)
+	}
+
+	reg := make([]uint64, len(h.reg))
+	for i, r := range h.reg {
+		reg[i] = uint64(r)
+	}
+	full := append([]byte{0x14, (regWidth-1)<<5 | log2m, 0x7f}, writeBitsMSB(reg, regWidth)...)
+
+	h1, err := FromPostgresHLL(explicit)
+	require.NoError(t, err)
+	h2, err := FromPostgresHLL(full)
+	require.NoError(t, err)
+	require.Equal(t, h1.reg, h2.reg)
+	require.InEpsilon(t, 5000, h2.Count(), 0.1)
+}
+
+func TestFromPostgresHLLError(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"11",
+		"218b7f",       // Version 2.
+		"108b7f",       // Undefined type.
+		"128b7f8895a3", // Truncated explicit value.
+		"118b7f00",     // Data in an empty sketch.
+		"11937f",       // log2m 19.
+	} {
+		_, err := FromPostgresHLL(pgBytes(t, s))
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,92 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol buffer field numbers and wire types of the message written by
+// HyperLogLog64.ProtoBytes, which corresponds to:
+//
+//	message HyperLogLog {
+//	  uint32 precision = 1;
+//	  bytes registers = 2;
+//	}
+const (
+	protoPrecisionField = 1
+	protoRegistersField = 2
+
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// ProtoBytes encodes HyperLogLog64 h as a protocol buffer message with the
+// precision as field 1 and the registers, one byte each, as field 2.
+func (h *HyperLogLog64) ProtoBytes() []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen32+2+len(h.reg))
+	b = binary.AppendUvarint(b, protoPrecisionField<<3|protoVarint)
+	b = binary.AppendUvarint(b, uint64(h.p))
+	b = binary.AppendUvarint(b, protoRegistersField<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(h.reg)))
+	return append(b, h.reg...)
+}
+
+// FromProtoBytes decodes a protocol buffer message written by ProtoBytes, or
+// by any implementation of the same message, into a new HyperLogLog64.
+// Unknown fields are skipped.
+func FromProtoBytes(b []byte) (*HyperLogLog64, error) {
+	var p uint64
+	var reg []byte
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("proto: %w: invalid field key", ErrInvalidEncoding)
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("proto: %w: invalid varint", ErrInvalidEncoding)
+			}
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		case protoBytes:
+			l, ln := binary.Uvarint(b)
+			if ln <= 0 || l > uint64(len(b)-ln) {
+				return nil, fmt.Errorf("proto: %w: invalid length", ErrInvalidEncoding)
+			}
+			data = b[ln : ln+int(l)]
+			n = ln + int(l)
+		default:
+			return nil, fmt.Errorf("proto: %w: unsupported wire type %d", ErrInvalidEncoding, key&7)
+		}
+		if n > len(b) {
+			return nil, fmt.Errorf("proto: %w: truncated field", ErrInvalidEncoding)
+		}
+		b = b[n:]
+
+		switch key {
+		case protoPrecisionField<<3 | protoVarint:
+			p = v
+		case protoRegistersField<<3 | protoBytes:
+			reg = data
+		}
+	}
+
+	if p > 0xff {
+		return nil, fmt.Errorf("proto: %w: precision %d out of range", ErrInvalidEncoding, p)
+	}
+	h, err := FromRegisters(uint8(p), append([]uint8(nil), reg...))
+	if err != nil {
+		return nil, fmt.Errorf("proto: %w: %w", ErrInvalidEncoding, err)
+	}
+	return h, nil
+}
@@ -0,0 +1,47 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtoBytesRoundTrip(t *testing.T) {
+	h, _ := New64(10)
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(rand.Uint64())
+	}
+
+	h2, err := FromProtoBytes(h.ProtoBytes())
+	require.NoError(t, err)
+	require.Equal(t, h.reg, h2.reg)
+	require.Equal(t, h.Count(), h2.Count())
+}
+
+func TestFromProtoBytes(t *testing.T) {
+	reg := bytes.Repeat([]byte{1, 2}, 8)
+
+	// The registers before the precision, with unknown varint, fixed32 and
+	// bytes fields around them, as other encoders may write them.
+	msg := []byte{0x18, 0x96, 0x01} // field 3 = 150
+	msg = append(msg, 0x12, 0x10)   // field 2, 16 bytes
+	msg = append(msg, reg...)
+	msg = append(msg, 0x25, 1, 2, 3, 4) // field 4 fixed32
+	msg = append(msg, 0x08, 0x04)       // field 1 = 4
+	msg = append(msg, 0x2a, 0x01, 'x')  // field 5, 1 byte
+
+	h, err := FromProtoBytes(msg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), h.p)
+	require.Equal(t, reg, h.reg)
+
+	// ProtoBytes writes fields in order, as generated code does.
+	require.Equal(t, append([]byte{0x08, 0x04, 0x12, 0x10}, reg...), h.ProtoBytes())
+
+	_, err = FromProtoBytes(msg[:10])
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+	_, err = FromProtoBytes([]byte{0x08, 0x04})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+}
@@ -0,0 +1,106 @@
+package hyperloglog
+
+import "fmt"
+
+// maxIntersectSketches is the largest number of sketches IntersectMany
+// accepts. The inclusion-exclusion expansion has 2^n-1 terms.
+const maxIntersectSketches = 5
+
+// IntersectMany estimates the cardinality of the intersection of the sets
+// represented by hs. It uses the full inclusion-exclusion expansion over the
+// union of every non-empty subset of hs. None of the sketches are modified.
+//
+// Every term of the expansion carries the estimation error of a union count,
+// while the intersection is usually much smaller than the unions, so the
+// relative error of the result grows quickly with the number of sketches. At
+// most 5 sketches are accepted.
+func IntersectMany(hs []*HyperLogLog64) (uint64, error) {
+	if len(hs) == 0 || len(hs) > maxIntersectSketches {
+		return 0, fmt.Errorf("number of sketches must be between 1 and %d", maxIntersectSketches)
+	}
+	for _, h := range hs[1:] {
+		if h.p != hs[0].p {
+			return 0, ErrPrecisionMismatch
+		}
+		if h.seed != hs[0].seed {
+			return 0, ErrSeedMismatch
+		}
+	}
+
+	u, err := New64WithSeed(hs[0].p, hs[0].seed, WithAlpha(hs[0].alpha), WithRounding(hs[0].rounding))
+	if err != nil {
+		return 0, err
+	}
+	u.estTables, u.biasTables = hs[0].estTables, hs[0].biasTables
+
+	var sum float64
+	for subset := 1; subset < 1<<len(hs); subset++ {
+		u.Clear()
+		var n int
+		for i, h := range hs {
+			if subset&(1<<i) != 0 {
+				if err := u.Merge(h); err != nil {
+					return 0, err
+				}
+				n++
+			}
+		}
+
+		if n%2 == 1 {
+			sum += float64(u.Count())
+		} else {
+			sum -= float64(u.Count())
+		}
+	}
+
+	if sum < 0 {
+		return 0, nil
+	}
+	return uint64(sum), nil
+}
+
+// UnionCount returns the cardinality estimate of the union of a and b. The
+// result is the same as counting a sketch with both merged into it, but the
+// merged registers are never stored.
+func UnionCount(a, b *HyperLogLog64) (uint64, error) {
+	if a.p != b.p {
+		return 0, ErrPrecisionMismatch
+	}
+	if a.seed != b.seed {
+		return 0, ErrSeedMismatch
+	}
+
+	var sum float64
+	var zeros uint32
+	for i, r := range a.reg {
+		if b.reg[i] > r {
+			r = b.reg[i]
+		}
+		if r == 0 {
+			zeros++
+		}
+		sum += 1.0 / float64(uint64(1)<<r)
+	}
+
+	n, _ := a.estimateFrom(sum, zeros)
+	return n, nil
+}
+
+// SymmetricDifference estimates the number of items in exactly one of the sets
+// represented by HyperLogLog64 h and other, e.g. the keys that changed
+// between two periods. With the intersection estimated by inclusion-exclusion
+// as in IntersectMany, |A △ B| = |A ∪ B| - |A ∩ B| = 2|A ∪ B| - |A| - |B|.
+// It carries the error of the union count twice over, which is large compared
+// to a small difference, and negative results are clamped to 0. Neither
+// sketch is modified.
+func (h *HyperLogLog64) SymmetricDifference(other *HyperLogLog64) (uint64, error) {
+	union, err := UnionCount(h, other)
+	if err != nil {
+		return 0, err
+	}
+
+	if d := 2*float64(union) - float64(h.Count()) - float64(other.Count()); d > 0 {
+		return uint64(d), nil
+	}
+	return 0, nil
+}
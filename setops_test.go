@@ -0,0 +1,180 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntersectMany(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(14)
+	c, _ := New64(14)
+
+	// 1e5 elements are in all three sets, 2e4 only in a and b, 5e4 only in
+	// each set.
+	for i := 0; i < 1e5; i++ {
+		x := rand.Uint64()
+		a.AddUint64(x)
+		b.AddUint64(x)
+		c.AddUint64(x)
+	}
+	for i := 0; i < 2e4; i++ {
+		x := rand.Uint64()
+		a.AddUint64(x)
+		b.AddUint64(x)
+	}
+	for _, h := range []*HyperLogLog64{a, b, c} {
+		for i := 0; i < 5e4; i++ {
+			h.AddUint64(rand.Uint64())
+		}
+	}
+
+	before := a.Count()
+	n, err := IntersectMany([]*HyperLogLog64{a, b, c})
+	require.NoError(t, err)
+	require.InEpsilon(t, 1e5, n, 0.2)
+	require.Equal(t, before, a.Count())
+
+	n, err = IntersectMany([]*HyperLogLog64{a, b})
+	require.NoError(t, err)
+	require.InEpsilon(t, 1.2e5, n, 0.2)
+
+	n, err = IntersectMany([]*HyperLogLog64{a})
+	require.NoError(t, err)
+	require.Equal(t, a.Count(), n)
+}
+
+func TestSetOpsSeeded(t *testing.T) {
+	a, _ := New64WithSeed(14, 7)
+	b, _ := New64WithSeed(14, 7)
+	// A = [0, 10000) and B = [5000, 15000) share 5000 items.
+	for i := uint64(0); i < 15000; i++ {
+		if i < 10000 {
+			a.AddUint64(fmix64(i))
+		}
+		if i >= 5000 {
+			b.AddUint64(fmix64(i))
+		}
+	}
+
+	n, err := IntersectMany([]*HyperLogLog64{a, b})
+	require.NoError(t, err)
+	require.InEpsilon(t, 5000, n, 0.1)
+	n, err = UnionCount(a, b)
+	require.NoError(t, err)
+	require.InEpsilon(t, 15000, n, 0.05)
+	n, err = a.SymmetricDifference(b)
+	require.NoError(t, err)
+	require.InEpsilon(t, 10000, n, 0.1)
+
+	c, _ := New64(14)
+	_, err = IntersectMany([]*HyperLogLog64{a, c})
+	require.ErrorIs(t, err, ErrSeedMismatch)
+	_, err = UnionCount(a, c)
+	require.ErrorIs(t, err, ErrSeedMismatch)
+}
+
+func TestIntersectManyError(t *testing.T) {
+	a, _ := New64(14)
+	b, _ := New64(12)
+
+	_, err := IntersectMany([]*HyperLogLog64{a, b})
+	require.Error(t, err)
+
+	_, err = IntersectMany(nil)
+	require.Error(t, err)
+
+	_, err = IntersectMany([]*HyperLogLog64{a, a, a, a, a, a})
+	require.Error(t, err)
+}
+
+func TestUnionCount(t *testing.T) {
+	for _, n := range []int{10, 1e3, 1e5} {
+		a, _ := New64(14)
+		b, _ := New64(14)
+		for i := 0; i < n; i++ {
+			a.AddUint64(rand.Uint64())
+			b.AddUint64(rand.Uint64())
+		}
+
+		u, _ := New64(14)
+		u.Merge(a)
+		u.Merge(b)
+
+		c, err := UnionCount(a, b)
+		require.NoError(t, err)
+		require.Equal(t, u.Count(), c)
+	}
+
+	a, _ := New64(14)
+	b, _ := New64(12)
+	_, err := UnionCount(a, b)
+	require.Error(t, err)
+}
+
+func TestSymmetricDifference(t *testing.T) {
+	// Between the two periods 2e4 keys are removed and 3e4 added, out of 1e5.
+	a, _ := New64(14)
+	b, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		x := r.Uint64()
+		if i >= 2e4 {
+			b.AddUint64(x)
+		}
+		a.AddUint64(x)
+	}
+	for i := 0; i < 3e4; i++ {
+		b.AddUint64(r.Uint64())
+	}
+
+	before := a.Count()
+	n, err := a.SymmetricDifference(b)
+	require.NoError(t, err)
+	require.InEpsilon(t, 5e4, n, 0.1)
+	require.Equal(t, before, a.Count())
+	m, err := b.SymmetricDifference(a)
+	require.NoError(t, err)
+	require.Equal(t, n, m)
+
+	n, err = a.SymmetricDifference(a.Clone())
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	c, _ := New64(12)
+	_, err = a.SymmetricDifference(c)
+	require.ErrorIs(t, err, ErrPrecisionMismatch)
+	s, _ := New64WithSeed(14, 1)
+	_, err = a.SymmetricDifference(s)
+	require.ErrorIs(t, err, ErrSeedMismatch)
+}
+
+func BenchmarkUnionCount(b *testing.B) {
+	for _, precision := range []uint8{14, 18} {
+		x, _ := New64(precision)
+		y, _ := New64(precision)
+		for i := 0; i < 1e6; i++ {
+			x.AddUint64(rand.Uint64())
+			y.AddUint64(rand.Uint64())
+		}
+
+		b.Run(fmt.Sprintf("precision=%d/UnionCount", precision), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				UnionCount(x, y)
+			}
+		})
+		b.Run(fmt.Sprintf("precision=%d/Merge", precision), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				u, _ := New64(precision)
+				u.Merge(x)
+				u.Merge(y)
+				u.Count()
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package hyperloglog
+
+// Sketch is implemented by the sketches whose dense registers are computed
+// the same way from 64-bit hashes, HyperLogLog64 and HyperLogLogPlus, so that
+// a mix of both can be aggregated with MergeInterop. The 32-bit HyperLogLog
+// computes its registers differently and does not implement it.
+type Sketch interface {
+	// Count returns the cardinality estimate.
+	Count() uint64
+
+	// Precision returns the precision of the sketch.
+	Precision() uint8
+
+	// DenseRegisters returns a copy of the registers of the sketch in the
+	// dense representation, without converting the sketch to it.
+	DenseRegisters() []uint8
+
+	// hashSeed returns the seed the added items are hashed with.
+	hashSeed() uint64
+
+	// mergeDense combines dense registers of the same precision with the
+	// sketch.
+	mergeDense(reg []uint8)
+}
+
+var (
+	_ Sketch = (*HyperLogLog64)(nil)
+	_ Sketch = (*HyperLogLogPlus)(nil)
+)
+
+// MergeInterop combines sketch src with sketch dst regardless of their
+// concrete types. The precisions and seeds must be equal. A sparse
+// HyperLogLogPlus dst is converted to the dense representation.
+func MergeInterop(dst, src Sketch) error {
+	if dst.Precision() != src.Precision() {
+		return ErrPrecisionMismatch
+	}
+	if dst.hashSeed() != src.hashSeed() {
+		return ErrSeedMismatch
+	}
+	if h, ok := dst.(*HyperLogLogPlus); ok && h.maxSparseBytes > 0 {
+		return errSparseBudget
+	}
+	dst.mergeDense(src.DenseRegisters())
+	return nil
+}
+
+// Precision returns the precision of HyperLogLog64 h.
+func (h *HyperLogLog64) Precision() uint8 {
+	return h.p
+}
+
+// DenseRegisters returns a copy of the registers of HyperLogLog64 h.
+func (h *HyperLogLog64) DenseRegisters() []uint8 {
+	return append([]uint8(nil), h.reg...)
+}
+
+func (h *HyperLogLog64) hashSeed() uint64 {
+	return h.seed
+}
+
+func (h *HyperLogLog64) mergeDense(reg []uint8) {
+	h.merged++
+	for i, v := range reg {
+		if v > h.reg[i] {
+			h.reg[i] = v
+		}
+	}
+	h.registersChanged()
+}
+
+// Precision returns the precision of HyperLogLogPlus h.
+func (h *HyperLogLogPlus) Precision() uint8 {
+	return h.p
+}
+
+// DenseRegisters returns the registers of HyperLogLogPlus h in the dense
+// representation. h is not converted to it.
+func (h *HyperLogLogPlus) DenseRegisters() []uint8 {
+	reg := make([]uint8, h.m)
+	h.ForEachSparse(func(i uint32, r uint8) {
+		reg[i] = r
+	})
+	return reg
+}
+
+// HyperLogLogPlus has no seed option, so its items are hashed unseeded.
+func (h *HyperLogLogPlus) hashSeed() uint64 {
+	return 0
+}
+
+func (h *HyperLogLogPlus) mergeDense(reg []uint8) {
+	h.count.Store(0)
+	if h.explicit {
+		h.toNormal()
+	} else if h.sparse {
+		h.mergeSparseAndToNormal()
+	}
+	h.blendOffset, h.blendBase = 0, 0
+	for i, v := range reg {
+		if v > h.reg[i] {
+			h.reg[i] = v
+		}
+	}
+}
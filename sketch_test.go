@@ -0,0 +1,58 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeInterop(t *testing.T) {
+	plus, _ := NewPlus(14)
+	h, _ := New64(14)
+	want, _ := New64(14)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		x := r.Uint64()
+		plus.AddUint64(x)
+		want.AddUint64(x)
+	}
+	for i := 0; i < 1e4; i++ {
+		x := r.Uint64()
+		h.AddUint64(x)
+		want.AddUint64(x)
+	}
+	require.Equal(t, "dense", plus.Mode())
+
+	require.NoError(t, MergeInterop(h, plus))
+	require.Equal(t, want.reg, h.reg)
+	require.Equal(t, want.Count(), h.Count())
+
+	// The other way around, into a sparse HyperLogLogPlus.
+	small, _ := NewPlus(14)
+	small.AddUint64(r.Uint64())
+	require.NoError(t, MergeInterop(small, h))
+	require.Equal(t, "dense", small.Mode())
+	require.InEpsilon(t, want.Count(), small.Count(), 0.01)
+
+	other, _ := New64(12)
+	require.ErrorIs(t, MergeInterop(other, plus), ErrPrecisionMismatch)
+	seeded, _ := New64WithSeed(14, 7)
+	require.ErrorIs(t, MergeInterop(seeded, plus), ErrSeedMismatch)
+	require.ErrorIs(t, MergeInterop(plus, seeded), ErrSeedMismatch)
+}
+
+func TestPlusDenseRegisters(t *testing.T) {
+	plus, _ := NewPlus(12)
+	h, _ := New64(12)
+	for _, n := range []int{10, 1000, 1e4} {
+		for plus.Count() < uint64(n) {
+			x := rand.Uint64()
+			plus.AddUint64(x)
+			h.AddUint64(x)
+		}
+		mode := plus.Mode()
+		require.Equal(t, h.reg, plus.DenseRegisters(), "mode=%s", mode)
+		require.Equal(t, mode, plus.Mode())
+	}
+}
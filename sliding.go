@@ -0,0 +1,57 @@
+package hyperloglog
+
+import "errors"
+
+// SlidingHLL counts distinct items over a sliding window, such as the last
+// hour, made of a fixed number of buckets, such as minutes. Items are added to
+// the current bucket, Rotate starts a new bucket in place of the oldest one,
+// and Count estimates the number of distinct items in all live buckets.
+type SlidingHLL struct {
+	buckets []*HyperLogLog64
+	cur     int
+	union   *HyperLogLog64
+}
+
+// NewSlidingHLL returns a new SlidingHLL with the given number of buckets,
+// each a HyperLogLog64 of the given precision.
+func NewSlidingHLL(precision uint8, buckets int) (*SlidingHLL, error) {
+	if buckets < 1 {
+		return nil, errors.New("number of buckets must be positive")
+	}
+
+	s := &SlidingHLL{buckets: make([]*HyperLogLog64, buckets)}
+	for i := range s.buckets {
+		h, err := New64(precision)
+		if err != nil {
+			return nil, err
+		}
+		s.buckets[i] = h
+	}
+	s.union, _ = New64(precision)
+	return s, nil
+}
+
+// Add adds a new item to the current bucket of SlidingHLL s.
+func (s *SlidingHLL) Add(item Hash64) {
+	s.AddUint64(item.Sum64())
+}
+
+// AddUint64 adds a new hash to the current bucket of SlidingHLL s.
+func (s *SlidingHLL) AddUint64(x uint64) {
+	s.buckets[s.cur].AddUint64(x)
+}
+
+// Rotate drops the oldest bucket of SlidingHLL s and makes a new, empty bucket
+// current.
+func (s *SlidingHLL) Rotate() {
+	s.cur = (s.cur + 1) % len(s.buckets)
+	s.buckets[s.cur].Clear()
+}
+
+// Count returns the cardinality estimate of the items in the live buckets of
+// SlidingHLL s.
+func (s *SlidingHLL) Count() uint64 {
+	s.union.Clear()
+	s.union.MergeMany(s.buckets...)
+	return s.union.Count()
+}
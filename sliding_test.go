@@ -0,0 +1,32 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingHLL(t *testing.T) {
+	s, err := NewSlidingHLL(14, 3)
+	require.NoError(t, err)
+
+	// Add 1e4 distinct items to each of four buckets; the first one expires.
+	for b := 0; b < 4; b++ {
+		if b > 0 {
+			s.Rotate()
+		}
+		for i := 0; i < 1e4; i++ {
+			s.AddUint64(rand.Uint64())
+		}
+	}
+	require.InEpsilon(t, 3e4, s.Count(), 0.03)
+
+	for b := 0; b < 3; b++ {
+		s.Rotate()
+	}
+	require.Zero(t, s.Count())
+
+	_, err = NewSlidingHLL(14, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package hyperloglog
+
+// HyperLogLogTailCut is a HyperLogLog with 4-bit registers, as described in
+// "HLL-TailCut: Improving Memory Efficiency of HyperLogLog" by Xiao et al.
+// Each register stores its rank as an offset from a base rank shared by all
+// registers, which is raised once every register is above it. Offsets larger
+// than 15 are cut to 15, so the error is somewhat larger than that of a
+// HyperLogLog64 of the same precision, in exchange for half the memory.
+type HyperLogLogTailCut struct {
+	reg   []uint8 // two 4-bit offsets per byte
+	m     uint32
+	p     uint8
+	base  uint8
+	zeros uint32 // number of zero offsets
+}
+
+const tailCutMaxOffset = 1<<4 - 1
+
+// NewTailCut returns a new initialized HyperLogLogTailCut.
+func NewTailCut(precision uint8) (*HyperLogLogTailCut, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
+	}
+
+	h := &HyperLogLogTailCut{}
+	h.p = precision
+	h.m = 1 << precision
+	h.Clear()
+	return h, nil
+}
+
+// Clear sets HyperLogLogTailCut h back to its initial state.
+func (h *HyperLogLogTailCut) Clear() {
+	h.reg = make([]uint8, h.m/2)
+	h.base = 0
+	h.zeros = h.m
+}
+
+func (h *HyperLogLogTailCut) get(i uint32) uint8 {
+	return h.reg[i>>1] >> (4 * (i & 1)) & tailCutMaxOffset
+}
+
+func (h *HyperLogLogTailCut) set(i uint32, v uint8) {
+	shift := 4 * (i & 1)
+	h.reg[i>>1] = h.reg[i>>1]&^(tailCutMaxOffset<<shift) | v<<shift
+}
+
+// Raises register i of HyperLogLogTailCut h to rank r, rebasing the registers
+// if none is left at the base rank.
+func (h *HyperLogLogTailCut) update(i uint32, r uint8) {
+	if r <= h.base {
+		return
+	}
+
+	off := h.get(i)
+	v := min(r-h.base, tailCutMaxOffset)
+	if v <= off {
+		return
+	}
+	h.set(i, v)
+
+	if off == 0 {
+		h.zeros--
+		for h.zeros == 0 {
+			h.rebase()
+		}
+	}
+}
+
+// Increments the base rank of HyperLogLogTailCut h, decrementing all offsets.
+func (h *HyperLogLogTailCut) rebase() {
+	h.base++
+	for i := uint32(0); i < h.m; i++ {
+		v := h.get(i) - 1
+		h.set(i, v)
+		if v == 0 {
+			h.zeros++
+		}
+	}
+}
+
+// Add adds a new item to HyperLogLogTailCut h.
+func (h *HyperLogLogTailCut) Add(item Hash64) {
+	h.AddUint64(item.Sum64())
+}
+
+// AddUint64 adds a new hash to HyperLogLogTailCut h.
+func (h *HyperLogLogTailCut) AddUint64(x uint64) {
+	i, r := indexRank64(x, h.p, maxRank64(h.p))
+	h.update(uint32(i), r)
+}
+
+// Merge takes another HyperLogLogTailCut and combines it with
+// HyperLogLogTailCut h.
+func (h *HyperLogLogTailCut) Merge(other *HyperLogLogTailCut) error {
+	if h.p != other.p {
+		return ErrPrecisionMismatch
+	}
+
+	for i := uint32(0); i < other.m; i++ {
+		if v := other.get(i); v != 0 || other.base != 0 {
+			h.update(i, other.base+v)
+		}
+	}
+	return nil
+}
+
+// Count returns the cardinality estimate.
+func (h *HyperLogLogTailCut) Count() uint64 {
+	var sum float64
+	var zeros uint32
+	for i := uint32(0); i < h.m; i++ {
+		r := h.base + h.get(i)
+		if r == 0 {
+			zeros++
+		}
+		sum += 1.0 / float64(uint64(1)<<r)
+	}
+
+	n, _ := (&HyperLogLog64{m: h.m, p: h.p}).estimateFrom(sum, zeros)
+	return n
+}
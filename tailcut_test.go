@@ -0,0 +1,67 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailCutCount(t *testing.T) {
+	const p = 14
+	// Allow about three times the standard error of a HyperLogLog64.
+	tolerance := 3 * 1.04 / math.Sqrt(1<<p)
+
+	for _, n := range []int{1e6, 1e7} {
+		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+			h, err := NewTailCut(p)
+			require.NoError(t, err)
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < n; i++ {
+				h.AddUint64(r.Uint64())
+			}
+
+			require.NotZero(t, h.base)
+			require.InEpsilon(t, n, h.Count(), tolerance)
+		})
+	}
+}
+
+func TestTailCutSmall(t *testing.T) {
+	h, _ := NewTailCut(14)
+	require.Zero(t, h.Count())
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	require.InEpsilon(t, 1000, h.Count(), 0.02)
+}
+
+func TestTailCutMerge(t *testing.T) {
+	a, _ := NewTailCut(12)
+	b, _ := NewTailCut(12)
+	u, _ := NewTailCut(12)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		x := r.Uint64()
+		a.AddUint64(x)
+		u.AddUint64(x)
+	}
+	for i := 0; i < 1e4; i++ {
+		x := r.Uint64()
+		b.AddUint64(x)
+		u.AddUint64(x)
+	}
+
+	// Cut offsets depend on the base at the time of the cut, so the merged
+	// registers can differ slightly from those of u.
+	require.NoError(t, b.Merge(a))
+	require.Equal(t, u.base, b.base)
+	require.InEpsilon(t, u.Count(), b.Count(), 0.001)
+
+	c, _ := NewTailCut(13)
+	require.ErrorIs(t, c.Merge(a), ErrPrecisionMismatch)
+}
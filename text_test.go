@@ -0,0 +1,44 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpText(t *testing.T) {
+	h, _ := New64(4)
+	h.AddUint64(0x1200000000000000) // register 1, rank 3
+	h.AddUint64(0xf0f0000000000000) // register 15, rank 5
+	require.Equal(t, "hll64 p=4 seed=0\n1 3\n15 5\n", h.DumpText())
+
+	h, _ = New64WithSeed(12, 7)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e4; i++ {
+		h.AddUint64(r.Uint64())
+	}
+	h2, err := ParseText(h.DumpText())
+	require.NoError(t, err)
+	require.True(t, h.Equal(h2))
+	require.Equal(t, h.Count(), h2.Count())
+	require.Equal(t, h.DumpText(), h2.DumpText())
+
+	for _, bad := range []string{
+		"",
+		"hll64 p=4\n",
+		"hll64 p=4 seed=0 extra\n",
+		"hll64 p=4 seed=0x\n",
+		"hll64 p=4 seed=+0\n",
+		"hll64 p=4 seed=0\n1\n",
+		"hll64 p=4 seed=0\n16 1\n",
+		"hll64 p=4 seed=0\n2 1\n1 1\n",
+		"hll64 p=4 seed=0\n1 0\n",
+		"hll64 p=4 seed=0\n1 62\n",
+	} {
+		_, err := ParseText(bad)
+		require.ErrorIs(t, err, ErrInvalidEncoding, "%q", bad)
+	}
+	_, err = ParseText("hll64 p=3 seed=0\n")
+	require.ErrorIs(t, err, ErrInvalidPrecision)
+}
@@ -0,0 +1,107 @@
+package hyperloglog
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// TimedHLL counts distinct items by the time they were seen, for questions
+// such as the number of distinct users active in the last hour. Time is cut
+// into buckets of a fixed width, such as a minute, each counted by its own
+// HyperLogLog64, and only the most recent buckets are kept, such as the last
+// day. Unlike SlidingHLL, buckets are chosen by the timestamp of each item, so
+// there is no need to rotate them.
+type TimedHLL struct {
+	buckets []*HyperLogLog64
+	nums    []int64 // bucket number held in each of buckets
+	width   time.Duration
+	newest  int64 // newest bucket number seen so far
+	started bool
+	union   *HyperLogLog64
+}
+
+// NewTimedHLL returns a new TimedHLL that keeps the given number of buckets of
+// the given width, each a HyperLogLog64 of the given precision.
+func NewTimedHLL(precision uint8, width time.Duration, buckets int) (*TimedHLL, error) {
+	if width <= 0 {
+		return nil, errors.New("bucket width must be positive")
+	}
+	if buckets < 1 {
+		return nil, errors.New("number of buckets must be positive")
+	}
+
+	s := &TimedHLL{
+		buckets: make([]*HyperLogLog64, buckets),
+		nums:    make([]int64, buckets),
+		width:   width,
+	}
+	for i := range s.buckets {
+		h, err := New64(precision)
+		if err != nil {
+			return nil, err
+		}
+		s.buckets[i] = h
+		s.nums[i] = math.MinInt64
+	}
+	s.union, _ = New64(precision)
+	return s, nil
+}
+
+// Returns the number of the bucket holding time t.
+func (s *TimedHLL) bucket(t time.Time) int64 {
+	n := t.UnixNano()
+	k := n / int64(s.width)
+	if n%int64(s.width) < 0 {
+		k--
+	}
+	return k
+}
+
+// Returns the slot of buckets holding bucket number k.
+func (s *TimedHLL) slot(k int64) int {
+	i := int(k % int64(len(s.buckets)))
+	if i < 0 {
+		i += len(s.buckets)
+	}
+	return i
+}
+
+// Reports whether bucket number k is still kept.
+func (s *TimedHLL) live(k int64) bool {
+	return s.started && k > s.newest-int64(len(s.buckets))
+}
+
+// AddAt adds a new hash seen at time t to TimedHLL s. A time newer than any
+// seen so far drops the buckets that no longer fit, and hashes seen before
+// the oldest bucket kept are ignored.
+func (s *TimedHLL) AddAt(x uint64, t time.Time) {
+	k := s.bucket(t)
+	if !s.started || k > s.newest {
+		s.newest, s.started = k, true
+	} else if !s.live(k) {
+		return
+	}
+
+	i := s.slot(k)
+	if s.nums[i] != k {
+		s.buckets[i].Clear()
+		s.nums[i] = k
+	}
+	s.buckets[i].AddUint64(x)
+}
+
+// CountSince returns the cardinality estimate of the hashes added to TimedHLL
+// s at time t or later. Whole buckets are counted, so the estimate includes
+// hashes seen earlier in the bucket holding t, and excludes anything older
+// than the oldest bucket kept.
+func (s *TimedHLL) CountSince(t time.Time) uint64 {
+	since := s.bucket(t)
+	s.union.Clear()
+	for i, k := range s.nums {
+		if k >= since && s.live(k) {
+			s.union.Merge(s.buckets[i])
+		}
+	}
+	return s.union.Count()
+}
@@ -0,0 +1,48 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimedHLL(t *testing.T) {
+	s, err := NewTimedHLL(14, time.Minute, 3)
+	require.NoError(t, err)
+
+	// Add 1e4 distinct items in each of four minutes; the first one expires.
+	r := rand.New(rand.NewSource(1))
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for b := 0; b < 4; b++ {
+		at := start.Add(time.Duration(b)*time.Minute + 30*time.Second)
+		for i := 0; i < 1e4; i++ {
+			s.AddAt(r.Uint64(), at)
+		}
+	}
+	require.InEpsilon(t, 3e4, s.CountSince(start), 0.03)
+	require.InEpsilon(t, 2e4, s.CountSince(start.Add(2*time.Minute)), 0.03)
+	require.InEpsilon(t, 1e4, s.CountSince(start.Add(3*time.Minute+time.Second)), 0.03)
+	require.Zero(t, s.CountSince(start.Add(4*time.Minute)))
+
+	// Items older than the buckets kept are ignored.
+	s.AddAt(r.Uint64(), start)
+	require.InEpsilon(t, 3e4, s.CountSince(start), 0.03)
+
+	// Late items go to their own bucket.
+	for i := 0; i < 1e4; i++ {
+		s.AddAt(r.Uint64(), start.Add(2*time.Minute))
+	}
+	require.InEpsilon(t, 1e4, s.CountSince(start.Add(3*time.Minute)), 0.03)
+	require.InEpsilon(t, 4e4, s.CountSince(start), 0.03)
+
+	// Moving far ahead drops every bucket.
+	s.AddAt(r.Uint64(), start.Add(time.Hour))
+	require.Equal(t, uint64(1), s.CountSince(start))
+
+	_, err = NewTimedHLL(14, 0, 3)
+	require.Error(t, err)
+	_, err = NewTimedHLL(14, time.Minute, 0)
+	require.Error(t, err)
+}
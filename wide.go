@@ -0,0 +1,143 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math"
+)
+
+// registerStore abstracts the storage of the registers of a
+// HyperLogLogWide, so that the same sketch code works with registers of
+// different widths.
+type registerStore interface {
+	// get returns register i.
+	get(i uint32) uint16
+	// raise sets register i to r if r is greater, saturating at the largest
+	// value the register can hold, and reports whether it changed.
+	raise(i uint32, r uint16) bool
+}
+
+type registers8 []uint8
+
+func (s registers8) get(i uint32) uint16 {
+	return uint16(s[i])
+}
+
+func (s registers8) raise(i uint32, r uint16) bool {
+	v := uint8(min(r, math.MaxUint8))
+	if v <= s[i] {
+		return false
+	}
+	s[i] = v
+	return true
+}
+
+type registers16 []uint16
+
+func (s registers16) get(i uint32) uint16 {
+	return s[i]
+}
+
+func (s registers16) raise(i uint32, r uint16) bool {
+	if r <= s[i] {
+		return false
+	}
+	s[i] = r
+	return true
+}
+
+// HyperLogLogWide is a HyperLogLog whose register width is chosen at
+// construction, for experimenting with hash functions or hash modes that
+// produce ranks beyond what a byte can hold. With 8-bit registers it behaves
+// like a HyperLogLog64; with 16-bit registers ranks up to 65535 are stored
+// exactly, at twice the memory. Ranks are usually added with AddRank, since
+// AddUint64 can only produce ranks up to 65-p.
+type HyperLogLogWide struct {
+	reg   registerStore
+	m     uint32
+	p     uint8
+	zeros uint32
+}
+
+// NewWide returns a new initialized HyperLogLogWide with registers of
+// registerBits bits, which must be 8 or 16.
+func NewWide(precision uint8, registerBits int) (*HyperLogLogWide, error) {
+	if err := checkPrecision64(precision); err != nil {
+		return nil, err
+	}
+
+	h := &HyperLogLogWide{}
+	h.p = precision
+	h.m = 1 << precision
+	switch registerBits {
+	case 8:
+		h.reg = make(registers8, h.m)
+	case 16:
+		h.reg = make(registers16, h.m)
+	default:
+		return nil, fmt.Errorf("register width must be 8 or 16 bits, got %d", registerBits)
+	}
+	h.zeros = h.m
+	return h, nil
+}
+
+// Precision returns the precision of HyperLogLogWide h.
+func (h *HyperLogLogWide) Precision() uint8 {
+	return h.p
+}
+
+// Register returns register i of HyperLogLogWide h.
+func (h *HyperLogLogWide) Register(i uint32) uint16 {
+	return h.reg.get(i)
+}
+
+// AddUint64 adds a new hash to HyperLogLogWide h.
+func (h *HyperLogLogWide) AddUint64(x uint64) {
+	i, r := indexRank64(x, h.p, maxRank64(h.p))
+	h.AddRank(uint32(i), uint16(r))
+}
+
+// AddRank raises register index of HyperLogLogWide h to rank if it is lower,
+// for hash functions whose ranks are computed by the caller. Ranks above the
+// largest value a register can hold are saturated. It panics if index is out
+// of range.
+func (h *HyperLogLogWide) AddRank(index uint32, rank uint16) {
+	if index >= h.m {
+		panic(fmt.Sprintf("hyperloglog: register index %d out of range for precision %d", index, h.p))
+	}
+	old := h.reg.get(index)
+	if h.reg.raise(index, rank) && old == 0 {
+		h.zeros--
+	}
+}
+
+// Merge takes another HyperLogLogWide and combines it with HyperLogLogWide h.
+// The sketches may have different register widths; ranks that do not fit the
+// registers of h are saturated.
+func (h *HyperLogLogWide) Merge(other *HyperLogLogWide) error {
+	if h.p != other.p {
+		return ErrPrecisionMismatch
+	}
+
+	for i := uint32(0); i < other.m; i++ {
+		if r := other.reg.get(i); r != 0 {
+			h.AddRank(i, r)
+		}
+	}
+	return nil
+}
+
+// Count returns the cardinality estimate. Estimates that do not fit a uint64
+// are returned as math.MaxUint64.
+func (h *HyperLogLogWide) Count() uint64 {
+	var sum float64
+	for i := uint32(0); i < h.m; i++ {
+		sum += math.Ldexp(1, -int(h.reg.get(i)))
+	}
+
+	fm := float64(h.m)
+	if alpha(h.m)*fm*fm/sum >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	n, _ := (&HyperLogLog64{m: h.m, p: h.p}).estimateFrom(sum, h.zeros)
+	return n
+}
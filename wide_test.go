@@ -0,0 +1,57 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWideMatchesHLL64(t *testing.T) {
+	h, _ := New64(14)
+	w8, _ := NewWide(14, 8)
+	w16, _ := NewWide(14, 16)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		x := r.Uint64()
+		h.AddUint64(x)
+		w8.AddUint64(x)
+		w16.AddUint64(x)
+	}
+
+	require.Equal(t, h.Count(), w8.Count())
+	require.Equal(t, h.Count(), w16.Count())
+}
+
+func TestWideHighRanks(t *testing.T) {
+	w8, _ := NewWide(10, 8)
+	w16, _ := NewWide(10, 16)
+
+	// Ranks of a hypothetical wide hash, far beyond what a byte holds.
+	r := rand.New(rand.NewSource(1))
+	ranks := make([]uint16, 1<<10)
+	for i := range ranks {
+		ranks[i] = 200 + uint16(r.Intn(400))
+		w8.AddRank(uint32(i), ranks[i])
+		w16.AddRank(uint32(i), ranks[i])
+		w16.AddRank(uint32(i), ranks[i]-100)
+	}
+
+	for i, rank := range ranks {
+		require.Equal(t, rank, w16.Register(uint32(i)))
+		require.Equal(t, min(rank, 255), w8.Register(uint32(i)))
+	}
+	require.Equal(t, uint64(1<<64-1), w16.Count())
+
+	// Merging into narrower registers saturates rather than wrapping.
+	n8, _ := NewWide(10, 8)
+	require.NoError(t, n8.Merge(w16))
+	for i, rank := range ranks {
+		require.Equal(t, min(rank, 255), n8.Register(uint32(i)))
+	}
+
+	other, _ := NewWide(11, 16)
+	require.ErrorIs(t, other.Merge(w16), ErrPrecisionMismatch)
+	_, err := NewWide(10, 32)
+	require.Error(t, err)
+}